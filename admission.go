@@ -0,0 +1,122 @@
+package buffstreams
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+)
+
+var (
+	// ErrTooManyConnections is the reason given to OnReject for connections
+	// refused because the listener was already serving MaxConnections clients.
+	ErrTooManyConnections = errors.New("The listener is serving it's MaxConnections.")
+	// ErrTooManyConnectionsFromIP is the reason given to OnReject for connections
+	// refused because their IP already had MaxConnectionsPerIP open.
+	ErrTooManyConnectionsFromIP = errors.New("The client's IP has it's MaxConnectionsPerIP open.")
+	// ErrAddressDenied is the reason given to OnReject for connections refused by
+	// the AllowCIDRs or DenyCIDRs.
+	ErrAddressDenied = errors.New("The client's address is not allowed to connect.")
+)
+
+// rejectionKind classifies the reason a connection was refused, for metrics
+func rejectionKind(err error) string {
+	switch err {
+	case ErrTooManyConnections:
+		return "max_connections"
+	case ErrTooManyConnectionsFromIP:
+		return "max_connections_per_ip"
+	case ErrAddressDenied:
+		return "denied"
+	case ErrInvalidProxyHeader, ErrProxyHeaderTimeout:
+		return "proxy_protocol"
+	default:
+		return "admission"
+	}
+}
+
+// remoteAddr returns the IP the connection came from, or the client's IP for a
+// connection relayed by a trusted proxy, with any IPv4 address unmapped from
+// IPv6 so it matches IPv4 prefixes
+func (c *TCPConn) remoteAddr() netip.Addr {
+	if c.clientAddress.IsValid() {
+		return c.clientAddress.Addr().Unmap()
+	}
+	if addr, ok := c.socket.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.AddrPort().Addr().Unmap()
+	}
+	return netip.Addr{}
+}
+
+// remoteIP returns the IP the connection came from, without it's port
+func (c *TCPConn) remoteIP() string {
+	return c.remoteAddr().String()
+}
+
+// allowed checks the address against the deny list, then the allow list
+func allowed(addr netip.Addr, allow []netip.Prefix, deny []netip.Prefix) bool {
+	for _, prefix := range deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(allow) == 0 {
+		return true
+	}
+	for _, prefix := range allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitConnection decides whether a newly accepted connection may be served,
+// and if so counts it against the connection limits until releaseConnection
+func (t *TCPListener) admitConnection(conn *TCPConn) error {
+	cfg := t.Config()
+	addr := conn.remoteAddr()
+	if !allowed(addr, cfg.AllowCIDRs, cfg.DenyCIDRs) {
+		return ErrAddressDenied
+	}
+	if cfg.Admit != nil {
+		if err := cfg.Admit(conn.info()); err != nil {
+			return err
+		}
+	}
+	ip := conn.remoteIP()
+	t.admissionLock.Lock()
+	defer t.admissionLock.Unlock()
+	if cfg.MaxConnections > 0 && t.openConnections >= cfg.MaxConnections {
+		return ErrTooManyConnections
+	}
+	if cfg.MaxConnectionsPerIP > 0 && t.openPerIP[ip] >= cfg.MaxConnectionsPerIP {
+		return ErrTooManyConnectionsFromIP
+	}
+	t.openConnections++
+	t.openPerIP[ip]++
+	return nil
+}
+
+// releaseConnection stops counting a connection admitted by admitConnection
+func (t *TCPListener) releaseConnection(conn *TCPConn) {
+	ip := conn.remoteIP()
+	t.admissionLock.Lock()
+	defer t.admissionLock.Unlock()
+	t.openConnections--
+	if t.openPerIP[ip]--; t.openPerIP[ip] == 0 {
+		delete(t.openPerIP, ip)
+	}
+}
+
+// reject closes a connection refused by admitConnection, and reports it
+func (t *TCPListener) reject(conn *TCPConn, reason error) {
+	conn.Close()
+	t.logger.log(slog.LevelInfo, "connection rejected", connAttrs(conn.info()), errAttrs(reason))
+	if t.metrics != nil {
+		t.metrics.ConnectionRejected(conn.address, rejectionKind(reason))
+	}
+	if onReject := t.handlers.Load().onReject; onReject != nil {
+		onReject(conn.info(), reason)
+	}
+}
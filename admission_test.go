@@ -0,0 +1,143 @@
+package buffstreams
+
+import (
+	"net/netip"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startAdmissionListener listens on port with cfg, sending the reason for each
+// rejected connection on the returned channel
+func startAdmissionListener(t *testing.T, port int, cfg TCPListenerConfig) (*TCPListener, chan error) {
+	rejected := make(chan error, 10)
+	cfg.Address = FormatAddress("", strconv.Itoa(port))
+	cfg.Callback = func([]byte) error { return nil }
+	cfg.OnReject = func(_ ConnectionInfo, err error) { rejected <- err }
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	return l, rejected
+}
+
+// expectRejection dials port, and waits for the listener to refuse it with want
+func expectRejection(t *testing.T, port int, rejected chan error, want error) {
+	conn, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(port))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-rejected:
+		if err != want {
+			t.Errorf("Expected the connection to be rejected with %v, actually got %v", want, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be rejected with %v", want)
+	}
+}
+
+func TestListenerMaxConnections(t *testing.T) {
+	metrics := NewInMemoryMetrics()
+	l, rejected := startAdmissionListener(t, 5071, TCPListenerConfig{MaxConnections: 2, Metrics: metrics})
+	defer l.Close()
+
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5071))
+	first, err := DialTCP(&TCPConnConfig{Address: address})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	second, err := DialTCP(&TCPConnConfig{Address: address})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer second.Close()
+	waitForConnections(t, l, 2)
+	expectRejection(t, 5071, rejected, ErrTooManyConnections)
+	if s := l.Snapshot(); s.Rejected["max_connections"] != 1 || s.ActiveConnections != 2 {
+		t.Errorf("Expected the rejection to be counted, and not opened, actually got %v, %d active", s.Rejected, s.ActiveConnections)
+	}
+
+	// Once one leaves, there's room for another
+	first.Close()
+	waitForConnections(t, l, 1)
+	third, err := DialTCP(&TCPConnConfig{Address: address})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer third.Close()
+	waitForConnections(t, l, 2)
+	if len(rejected) != 0 {
+		t.Errorf("Expected the connection to be admitted, actually got %v", <-rejected)
+	}
+}
+
+func TestListenerMaxConnectionsPerIP(t *testing.T) {
+	l, rejected := startAdmissionListener(t, 5072, TCPListenerConfig{MaxConnectionsPerIP: 1})
+	defer l.Close()
+
+	first, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5072))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer first.Close()
+	waitForConnections(t, l, 1)
+	expectRejection(t, 5072, rejected, ErrTooManyConnectionsFromIP)
+}
+
+func TestListenerAllowAndDenyLists(t *testing.T) {
+	loopback := netip.MustParsePrefix("127.0.0.0/8")
+	l, rejected := startAdmissionListener(t, 5073, TCPListenerConfig{
+		AllowCIDRs: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	expectRejection(t, 5073, rejected, ErrAddressDenied)
+	l.Close()
+
+	l, rejected = startAdmissionListener(t, 5074, TCPListenerConfig{
+		AllowCIDRs: []netip.Prefix{loopback},
+		DenyCIDRs:  []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+	})
+	expectRejection(t, 5074, rejected, ErrAddressDenied)
+	l.Close()
+}
+
+func TestListenerAdmitFunc(t *testing.T) {
+	var admitted atomic.Int32
+	l, rejected := startAdmissionListener(t, 5075, TCPListenerConfig{
+		Admit: func(info ConnectionInfo) error {
+			if admitted.Add(1) > 1 {
+				return ErrConnectionNotFound
+			}
+			return nil
+		},
+	})
+	defer l.Close()
+
+	first, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5075))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer first.Close()
+	waitForConnections(t, l, 1)
+	expectRejection(t, 5075, rejected, ErrConnectionNotFound)
+}
+
+func TestListenerAcceptDuringShutdownIsNotCounted(t *testing.T) {
+	metrics := NewInMemoryMetrics()
+	l, _ := startAdmissionListener(t, 5085, TCPListenerConfig{Metrics: metrics})
+	l.Close()
+
+	// A connection accepted just before the socket closed
+	conn, client := rawPair(t, l.currentConnConfig())
+	defer client.Close()
+	l.accept(conn)
+	if state := conn.State(); state != StateClosed {
+		t.Errorf("Expected the connection to be closed, actually %s", state)
+	}
+	if s := l.Snapshot(); s.ActiveConnections != 0 {
+		t.Errorf("Expected no active connections, actually %d", s.ActiveConnections)
+	}
+}
@@ -0,0 +1,233 @@
+package buffstreams
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"time"
+)
+
+// ErrAuthenticationFailed is returned by DialTCP and Reopen when the listener
+// refuses the connections Credentials, and is the reason given to OnReject when
+// a built in Authenticator refuses a client.
+var ErrAuthenticationFailed = errors.New("Authentication failed.")
+
+// ErrHandshakeMessageTooLarge is returned when writing a handshake message over
+// 65535 bytes.
+var ErrHandshakeMessageTooLarge = errors.New("Handshake messages may not exceed 65535 bytes.")
+
+// DefaultAuthTimeout is how long the authentication handshake may take, if no
+// AuthTimeout is configured.
+const DefaultAuthTimeout = 10 * time.Second
+
+// Handshake carries the messages of an authentication handshake, before the
+// connection is handed over to normal use. Handshake messages have their own
+// framing, so they are unaffected by MaxMessageSize and EnableMetadata.
+type Handshake interface {
+	ReadMessage() ([]byte, error)
+	WriteMessage(data []byte) error
+}
+
+// Authenticator runs the listener side of an authentication handshake, for each
+// client a TCPListener accepts.
+type Authenticator interface {
+	// Authenticate returns the principal the client authenticated as, or an
+	// error to refuse it.
+	Authenticate(info ConnectionInfo, h Handshake) (string, error)
+}
+
+// Credentials run the client side of an authentication handshake, each time a
+// TCPConn connects.
+type Credentials interface {
+	Respond(h Handshake) error
+}
+
+// Handshake outcomes, sent by the listener once the Authenticator is done
+const (
+	authRejected byte = 0
+	authAccepted byte = 1
+)
+
+// socketHandshake frames each message with a 2 byte length
+type socketHandshake struct {
+	sock *net.TCPConn
+}
+
+// ReadMessage implements Handshake
+func (h socketHandshake) ReadMessage() ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(h.sock, size[:]); err != nil {
+		return nil, err
+	}
+	data := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(h.sock, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// WriteMessage implements Handshake
+func (h socketHandshake) WriteMessage(data []byte) error {
+	if len(data) > math.MaxUint16 {
+		return ErrHandshakeMessageTooLarge
+	}
+	frame := make([]byte, 2+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	copy(frame[2:], data)
+	_, err := h.sock.Write(frame)
+	return err
+}
+
+// respond runs the client side of the handshake over a freshly dialed socket,
+// before anything else can use it
+func respond(sock *net.TCPConn, creds Credentials, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DefaultAuthTimeout
+	}
+	sock.SetDeadline(time.Now().Add(timeout))
+	defer sock.SetDeadline(time.Time{})
+	h := socketHandshake{sock: sock}
+	if err := creds.Respond(h); err != nil {
+		return err
+	}
+	outcome, err := h.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if len(outcome) != 1 || outcome[0] != authAccepted {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+// authenticate runs the listener side of the handshake for a newly accepted
+// connection, recording the principal it authenticated as
+func (t *TCPListener) authenticate(conn *TCPConn, auth Authenticator, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = DefaultAuthTimeout
+	}
+	conn.setReadDeadline(conn.socket, time.Now().Add(timeout))
+	conn.socket.SetWriteDeadline(time.Now().Add(timeout))
+	defer conn.socket.SetWriteDeadline(time.Time{})
+	defer conn.setReadDeadline(conn.socket, time.Time{})
+	defer t.interruptOnShutdown(conn)()
+	h := socketHandshake{sock: conn.socket}
+	principal, err := auth.Authenticate(conn.info(), h)
+	if err != nil {
+		// The reason is only for the listener, the client just learns it failed
+		h.WriteMessage([]byte{authRejected})
+		return err
+	}
+	if err := h.WriteMessage([]byte{authAccepted}); err != nil {
+		return err
+	}
+	conn.principal = principal
+	return nil
+}
+
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal the client authenticated as, for
+// the context given to a ContextCallback on a listener with an Authenticator.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	p, ok := ctx.Value(principalKey{}).(string)
+	return p, ok
+}
+
+// TokenAuthenticator accepts clients presenting one of it's bearer tokens, as
+// sent by TokenCredentials. It maps each token to the principal it
+// authenticates as.
+type TokenAuthenticator map[string]string
+
+// Authenticate implements Authenticator
+func (a TokenAuthenticator) Authenticate(_ ConnectionInfo, h Handshake) (string, error) {
+	token, err := h.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	// Compare against every token, so the time taken doesn't give away how
+	// close the guess was
+	principal, found := "", false
+	for candidate, p := range a {
+		if subtle.ConstantTimeCompare(token, []byte(candidate)) == 1 {
+			principal, found = p, true
+		}
+	}
+	if !found {
+		return "", ErrAuthenticationFailed
+	}
+	return principal, nil
+}
+
+// TokenCredentials presents a bearer token to a TokenAuthenticator.
+type TokenCredentials string
+
+// Respond implements Credentials
+func (c TokenCredentials) Respond(h Handshake) error {
+	return h.WriteMessage([]byte(c))
+}
+
+// hmacChallengeSize is the number of random bytes in an HMAC challenge
+const hmacChallengeSize = 32
+
+// HMACAuthenticator accepts clients that prove they know the shared secret for
+// their ID, without sending it, by signing a random challenge with HMAC-SHA256.
+// It maps each client ID, which is the principal it authenticates as, to it's
+// secret.
+type HMACAuthenticator map[string][]byte
+
+// Authenticate implements Authenticator
+func (a HMACAuthenticator) Authenticate(_ ConnectionInfo, h Handshake) (string, error) {
+	challenge := make([]byte, hmacChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+	if err := h.WriteMessage(challenge); err != nil {
+		return "", err
+	}
+	// The response is the signature, followed by the client ID
+	response, err := h.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	if len(response) < sha256.Size {
+		return "", ErrAuthenticationFailed
+	}
+	id := string(response[sha256.Size:])
+	secret, ok := a[id]
+	if !ok || !hmac.Equal(response[:sha256.Size], signChallenge(secret, challenge, id)) {
+		return "", ErrAuthenticationFailed
+	}
+	return id, nil
+}
+
+// HMACCredentials answer the challenge of an HMACAuthenticator.
+type HMACCredentials struct {
+	ID     string
+	Secret []byte
+}
+
+// Respond implements Credentials
+func (c HMACCredentials) Respond(h Handshake) error {
+	challenge, err := h.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return h.WriteMessage(append(signChallenge(c.Secret, challenge, c.ID), c.ID...))
+}
+
+// signChallenge signs the challenge along with the ID, so a response can't be
+// replayed under another ID
+func signChallenge(secret []byte, challenge []byte, id string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(challenge)
+	mac.Write([]byte(id))
+	return mac.Sum(nil)
+}
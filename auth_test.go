@@ -0,0 +1,127 @@
+package buffstreams
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startAuthListener listens on port with auth, sending the principal of each
+// message received on the first channel, and each rejection on the second
+func startAuthListener(t *testing.T, port int, auth Authenticator, metrics Metrics) (*TCPListener, chan string, chan error) {
+	principals := make(chan string, 10)
+	rejected := make(chan error, 10)
+	cfg := TCPListenerConfig{
+		Address:       FormatAddress("", strconv.Itoa(port)),
+		Metrics:       metrics,
+		Authenticator: auth,
+		AuthTimeout:   100 * time.Millisecond,
+		ContextCallback: func(ctx context.Context, _ []byte) error {
+			principal, _ := PrincipalFromContext(ctx)
+			principals <- principal
+			return nil
+		},
+		OnReject: func(_ ConnectionInfo, err error) { rejected <- err },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	return l, principals, rejected
+}
+
+// expectPrincipal writes a message over conn, and waits for the listener to
+// receive it from want
+func expectPrincipal(t *testing.T, conn *TCPConn, principals chan string, want string) {
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("Expected Write to succeed, actually got %s", err)
+	}
+	select {
+	case principal := <-principals:
+		if principal != want {
+			t.Errorf("Expected the message to come from %s, actually %s", want, principal)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the message to reach the Callback")
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	metrics := NewInMemoryMetrics()
+	l, principals, rejected := startAuthListener(t, 5076, TokenAuthenticator{"s3cret": "alice"}, metrics)
+	defer l.Close()
+
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5076))
+	conn, err := DialTCP(&TCPConnConfig{Address: address, Credentials: TokenCredentials("s3cret")})
+	if err != nil {
+		t.Fatalf("Expected to authenticate, actually got %s", err)
+	}
+	defer conn.Close()
+	expectPrincipal(t, conn, principals, "alice")
+	if infos := l.Connections(); len(infos) != 1 || infos[0].Principal != "alice" {
+		t.Errorf("Expected the connection to be listed with it's principal, actually got %+v", infos)
+	}
+
+	if _, err := DialTCP(&TCPConnConfig{Address: address, Credentials: TokenCredentials("guess")}); err != ErrAuthenticationFailed {
+		t.Errorf("Expected ErrAuthenticationFailed, actually got %v", err)
+	}
+	if err := <-rejected; err != ErrAuthenticationFailed {
+		t.Errorf("Expected the rejection to be reported with ErrAuthenticationFailed, actually got %v", err)
+	}
+	if s := l.Snapshot(); s.Rejected["unauthenticated"] != 1 {
+		t.Errorf("Expected the rejection to be counted, actually got %v", s.Rejected)
+	}
+}
+
+func TestHMACAuthentication(t *testing.T) {
+	secret := []byte("shared secret")
+	l, principals, rejected := startAuthListener(t, 5077, HMACAuthenticator{"ingest": secret}, nil)
+	defer l.Close()
+
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5077))
+	conn, err := DialTCP(&TCPConnConfig{Address: address, Credentials: HMACCredentials{ID: "ingest", Secret: secret}})
+	if err != nil {
+		t.Fatalf("Expected to authenticate, actually got %s", err)
+	}
+	defer conn.Close()
+	expectPrincipal(t, conn, principals, "ingest")
+	// Each new socket has to authenticate again
+	if err := conn.Reopen(); err != nil {
+		t.Fatalf("Expected to authenticate again on Reopen, actually got %s", err)
+	}
+	expectPrincipal(t, conn, principals, "ingest")
+
+	creds := HMACCredentials{ID: "ingest", Secret: []byte("wrong secret")}
+	if _, err := DialTCP(&TCPConnConfig{Address: address, Credentials: creds}); err != ErrAuthenticationFailed {
+		t.Errorf("Expected ErrAuthenticationFailed, actually got %v", err)
+	}
+	if err := <-rejected; err != ErrAuthenticationFailed {
+		t.Errorf("Expected the rejection to be reported with ErrAuthenticationFailed, actually got %v", err)
+	}
+}
+
+func TestAuthenticationTimesOut(t *testing.T) {
+	l, principals, rejected := startAuthListener(t, 5078, TokenAuthenticator{"s3cret": "alice"}, nil)
+	defer l.Close()
+
+	// A client that never authenticates is dropped before anything is read from it
+	raw, err := net.Dial("tcp", FormatAddress("127.0.0.1", strconv.Itoa(5078)))
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer raw.Close()
+	select {
+	case err := <-rejected:
+		if err == nil {
+			t.Errorf("Expected the unauthenticated client to be rejected with the timeout")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the unauthenticated client to be rejected")
+	}
+	if len(principals) != 0 || len(l.Connections()) != 0 {
+		t.Errorf("Expected the unauthenticated client never to be served")
+	}
+}
@@ -0,0 +1,132 @@
+package buffstreams
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// AutoDialConfig lets a Manager dial addresses on the first Write to them,
+// rather than requiring Dial to be called up front.
+type AutoDialConfig struct {
+	// Template is the configuration used to dial any address without an Override.
+	// It's Address is replaced with the address being written to.
+	Template TCPConnConfig
+	// Overrides are used in place of Template for specific addresses
+	Overrides map[string]TCPConnConfig
+	// IdleTimeout closes auto dialed connections that haven't been written to for
+	// this long. They are dialed again on the next Write. 0 keeps them open.
+	IdleTimeout time.Duration
+}
+
+// minEvictInterval is the most often idle connections are checked for, however
+// short the IdleTimeout
+const minEvictInterval = time.Millisecond
+
+// dialCall is a dial in progress, which concurrent Writes to the same address
+// wait on rather than dialing again
+type dialCall struct {
+	done chan struct{}
+	err  error
+}
+
+// EnableAutoDial makes Write dial any address that hasn't been dialed yet, using
+// cfg, instead of returning ErrNotOpened. Concurrent first Writes to an address
+// share a single dial. Calling it again replaces the configuration.
+func (bm *Manager) EnableAutoDial(cfg AutoDialConfig) {
+	bm.autoDialLock.Lock()
+	defer bm.autoDialLock.Unlock()
+	if bm.evictorStop != nil {
+		close(bm.evictorStop)
+		bm.evictorStop = nil
+	}
+	bm.autoDialConfig = &cfg
+	if cfg.IdleTimeout > 0 && !bm.isShutdown() {
+		bm.evictorStop = make(chan struct{})
+		go bm.evictIdle(cfg.IdleTimeout, bm.evictorStop)
+	}
+}
+
+// autoDial dials address with the auto dial configuration, and caches the
+// connection for Write to find. It returns ErrNotOpened if auto dialing is not
+// enabled.
+func (bm *Manager) autoDial(address string) error {
+	bm.autoDialLock.Lock()
+	if bm.autoDialConfig == nil {
+		bm.autoDialLock.Unlock()
+		return ErrNotOpened
+	}
+	if call, ok := bm.dialing[address]; ok {
+		bm.autoDialLock.Unlock()
+		<-call.done
+		return call.err
+	}
+	cfg, ok := bm.autoDialConfig.Overrides[address]
+	if !ok {
+		cfg = bm.autoDialConfig.Template
+	}
+	cfg.Address = address
+	call := &dialCall{done: make(chan struct{})}
+	bm.dialing[address] = call
+	bm.autoDialLock.Unlock()
+
+	call.err = bm.storeAutoDialed(&cfg)
+	close(call.done)
+
+	bm.autoDialLock.Lock()
+	delete(bm.dialing, address)
+	bm.autoDialLock.Unlock()
+	return call.err
+}
+
+func (bm *Manager) storeAutoDialed(cfg *TCPConnConfig) error {
+	btc, err := DialTCP(cfg)
+	if err != nil {
+		return err
+	}
+	bm.dialerLock.Lock()
+	defer bm.dialerLock.Unlock()
+	if bm.isShutdown() {
+		btc.Close()
+		return ErrManagerShutdown
+	}
+	if bm.isDialed(cfg.Address) {
+		// An explicit Dial or DialPool beat us to it, so use theirs
+		btc.Close()
+		return nil
+	}
+	bm.dialedConnections[cfg.Address] = btc
+	lastWrite := &atomic.Int64{}
+	lastWrite.Store(time.Now().UnixNano())
+	bm.autoDialed[cfg.Address] = lastWrite
+	return nil
+}
+
+// evictIdle closes the auto dialed connections that haven't been written to
+// within timeout, until stop is closed. A Write blocked on one for longer fails,
+// and the connection stays closed, to be dialed again by the next Write.
+func (bm *Manager) evictIdle(timeout time.Duration, stop chan struct{}) {
+	// The tiniest timeouts would otherwise have the ticker spin, or panic at 0
+	interval := timeout / 2
+	if interval < minEvictInterval {
+		interval = minEvictInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		cutoff := time.Now().Add(-timeout).UnixNano()
+		bm.dialerLock.Lock()
+		for address, lastWrite := range bm.autoDialed {
+			if lastWrite.Load() < cutoff {
+				bm.dialedConnections[address].Close()
+				delete(bm.dialedConnections, address)
+				delete(bm.autoDialed, address)
+			}
+		}
+		bm.dialerLock.Unlock()
+	}
+}
@@ -10,6 +10,10 @@ const Version string = "2.0.0"
 // a MaxMessageSize of 0
 const DefaultMaxMessageSize int = 4096
 
+// DefaultMaxHeaderSize is the value that is used if EnableMetadata is set and
+// a config indicates a MaxHeaderSize of 0
+const DefaultMaxHeaderSize int = 256
+
 // FormatAddress is to cover the event that you want/need a programmtically correct way
 // to format an address/port to use with StartListening or WriteTo
 func FormatAddress(address string, port string) string {
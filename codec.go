@@ -0,0 +1,150 @@
+package buffstreams
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"reflect"
+)
+
+// Codec converts values to and from the bytes sent as a message. Unmarshal is
+// always given a pointer to decode into.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec is a Codec using encoding/json.
+type JSONCodec struct{}
+
+// Marshal implements Codec
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Codec
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec is a Codec using encoding/gob. Each message is encoded on it's own,
+// so it carries it's type information with it.
+type GobCodec struct{}
+
+// Marshal implements Codec
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Unmarshal implements Codec
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// EncodeError is returned by a Sender when the Codec fails to encode a value.
+// Nothing is written to the connection.
+type EncodeError struct {
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	return "buffstreams: encoding message: " + e.Err.Error()
+}
+
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodeError is returned by a Receiver, and from a TypedCallback, when the
+// Codec fails to decode a message. It distinguishes a bad message from an
+// error returned by the handler, which is passed through unwrapped.
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "buffstreams: decoding message: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Sender writes values of type T to a TCPConn, encoding each with a Codec.
+type Sender[T any] struct {
+	conn  *TCPConn
+	codec Codec
+}
+
+// NewSender creates a Sender that writes to conn
+func NewSender[T any](conn *TCPConn, codec Codec) *Sender[T] {
+	return &Sender[T]{conn: conn, codec: codec}
+}
+
+// Send encodes v and writes it as a single message, returning the bytes
+// written. If v can't be encoded, the error is an *EncodeError.
+func (s *Sender[T]) Send(v T) (int, error) {
+	data, err := s.codec.Marshal(v)
+	if err != nil {
+		return 0, &EncodeError{Err: err}
+	}
+	return s.conn.Write(data)
+}
+
+// Receiver reads values of type T from a TCPConn, decoding each with a Codec.
+// This is how a client reads the messages a TCPListener sends back to it.
+type Receiver[T any] struct {
+	conn   *TCPConn
+	codec  Codec
+	buffer []byte
+}
+
+// NewReceiver creates a Receiver that reads from conn
+func NewReceiver[T any](conn *TCPConn, codec Codec) *Receiver[T] {
+	return &Receiver[T]{conn: conn, codec: codec, buffer: make([]byte, conn.maxMessageSize)}
+}
+
+// Receive blocks until a message is read, and returns it decoded. If the message
+// can't be decoded, the error is a *DecodeError and the connection remains usable.
+func (r *Receiver[T]) Receive() (T, error) {
+	n, err := r.conn.Read(r.buffer)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return decode[T](r.codec, r.buffer[:n])
+}
+
+// TypedCallback adapts a handler of values of type T into a ListenCallback,
+// decoding each message with codec before it is handed over. A message that
+// can't be decoded never reaches the handler, and is reported to OnCallbackError
+// as a *DecodeError, while errors from the handler are reported as they are.
+func TypedCallback[T any](codec Codec, handler func(T) error) ListenCallback {
+	return func(data []byte) error {
+		v, err := decode[T](codec, data)
+		if err != nil {
+			return err
+		}
+		return handler(v)
+	}
+}
+
+// decode unmarshals data into a new T. When T is a pointer type, such as a
+// generated protobuf message, a new value is allocated for it to point to.
+func decode[T any](codec Codec, data []byte) (T, error) {
+	var v T
+	var target interface{} = &v
+	if t := reflect.TypeOf(v); t != nil && t.Kind() == reflect.Ptr {
+		v = reflect.New(t.Elem()).Interface().(T)
+		target = v
+	}
+	if err := codec.Unmarshal(data, target); err != nil {
+		var zero T
+		return zero, &DecodeError{Err: err}
+	}
+	return v, nil
+}
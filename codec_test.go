@@ -0,0 +1,99 @@
+package buffstreams
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type codecTestEvent struct {
+	Name  string
+	Count int
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	for name, codec := range map[string]Codec{"json": JSONCodec{}, "gob": GobCodec{}} {
+		data, err := codec.Marshal(codecTestEvent{Name: "a", Count: 2})
+		if err != nil {
+			t.Fatalf("%s: Failed to marshal: %s", name, err)
+		}
+		// Both value and pointer type parameters decode
+		if v, err := decode[codecTestEvent](codec, data); err != nil || v.Count != 2 {
+			t.Errorf("%s: Expected to decode a value, actually got %+v, %v", name, v, err)
+		}
+		if v, err := decode[*codecTestEvent](codec, data); err != nil || v.Name != "a" {
+			t.Errorf("%s: Expected to decode a pointer, actually got %+v, %v", name, v, err)
+		}
+	}
+}
+
+func TestTypedCallbackSeparatesDecodeErrors(t *testing.T) {
+	handlerErr := errors.New("handler failed")
+	callback := TypedCallback[codecTestEvent](JSONCodec{}, func(e codecTestEvent) error {
+		if e.Count < 0 {
+			return handlerErr
+		}
+		return nil
+	})
+	var decodeErr *DecodeError
+	if err := callback([]byte("{not json")); !errors.As(err, &decodeErr) {
+		t.Errorf("Expected a *DecodeError, actually got %v", err)
+	}
+	if err := callback([]byte(`{"Count":-1}`)); err != handlerErr {
+		t.Errorf("Expected the handler error to be passed through, actually got %v", err)
+	}
+	if err := callback([]byte(`{"Count":1}`)); err != nil {
+		t.Errorf("Expected no error, actually got %v", err)
+	}
+}
+
+func TestSenderAndReceiver(t *testing.T) {
+	received := make(chan codecTestEvent, 1)
+	cfg := TCPListenerConfig{
+		Address: FormatAddress("", strconv.Itoa(5046)),
+		Callback: TypedCallback[codecTestEvent](GobCodec{}, func(e codecTestEvent) error {
+			received <- e
+			return nil
+		}),
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5046))}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+
+	if _, err := NewSender[codecTestEvent](c, GobCodec{}).Send(codecTestEvent{Name: "up", Count: 1}); err != nil {
+		t.Fatalf("Failed to send to %s: %s", connCfg.Address, err)
+	}
+	select {
+	case e := <-received:
+		if e.Name != "up" || e.Count != 1 {
+			t.Errorf("Expected the event to round trip, actually got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected to receive the event")
+	}
+
+	// And back the other way, to the client
+	infos := waitForConnections(t, l, 1)
+	data, _ := GobCodec{}.Marshal(codecTestEvent{Name: "down", Count: 2})
+	if _, err := l.SendTo(infos[0].ID, data); err != nil {
+		t.Fatalf("Failed to send to connection %d: %s", infos[0].ID, err)
+	}
+	if e, err := NewReceiver[codecTestEvent](c, GobCodec{}).Receive(); err != nil || e.Name != "down" {
+		t.Errorf("Expected to receive the event, actually got %+v, %v", e, err)
+	}
+
+	var encodeErr *EncodeError
+	if _, err := NewSender[chan int](c, JSONCodec{}).Send(make(chan int)); !errors.As(err, &encodeErr) {
+		t.Errorf("Expected an *EncodeError, actually got %v", err)
+	}
+}
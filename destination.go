@@ -0,0 +1,506 @@
+package buffstreams
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"math/rand/v2"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHealthyBackends is returned when writing to a destination whose backends
+// have all been ejected.
+var ErrNoHealthyBackends = errors.New("No healthy backends are available for this destination.")
+
+// ErrUnknownDestination is returned when a caller uses a destination name that
+// has not been added to the Manager.
+var ErrUnknownDestination = errors.New("This destination has not been added.")
+
+// BalanceStrategy decides which backend of a destination each write goes to.
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin cycles through the healthy backends in turn
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceRandom picks a healthy backend at random
+	BalanceRandom
+	// BalanceConsistentHash sends every write with the same key to the same
+	// backend, for as long as it stays healthy
+	BalanceConsistentHash
+	// BalanceLeastOutstanding picks the healthy backend with the fewest writes
+	// in progress
+	BalanceLeastOutstanding
+)
+
+const (
+	// DefaultEjectAfter is the value that is used if a DestinationConfig indicates
+	// an EjectAfter of 0
+	DefaultEjectAfter = 3
+	// DefaultReadmitInterval is the value that is used if a DestinationConfig
+	// indicates a ReadmitInterval of 0
+	DefaultReadmitInterval = time.Second
+)
+
+// Each backend is placed on the consistent hash ring this many times, to even
+// out the share of keys each one receives
+const hashRingReplicas = 64
+
+// DestinationConfig represents the information needed to spread writes across
+// a set of identical backends.
+type DestinationConfig struct {
+	// Addresses of the backends. It is ignored if Resolver is set.
+	Addresses []string
+	// Resolver, if set, provides the addresses of the backends instead. It is
+	// called every ResolveInterval, and backends are added and removed to match.
+	Resolver Resolver
+	// ResolveInterval controls how often the Resolver is called
+	ResolveInterval time.Duration
+	// OnResolveError is invoked when the Resolver fails, other than when the
+	// destination is first added. The current backends are kept.
+	OnResolveError func(err error)
+	// Conn is the template every backend connection is dialed with. It's Address
+	// is replaced with that of the backend.
+	Conn TCPConnConfig
+	// Strategy decides which backend each write goes to
+	Strategy BalanceStrategy
+	// EjectAfter is the number of consecutive failed writes after which a
+	// backend is ejected, and no longer receives writes
+	EjectAfter int
+	// ReadmitInterval controls how often ejected backends are redialed. A
+	// backend is readmitted once it can be dialed again.
+	ReadmitInterval time.Duration
+}
+
+// BackendHealth describes the state of one of a destinations backends.
+type BackendHealth struct {
+	Address string
+	// Ejected is true while the backend is receiving no writes
+	Ejected bool
+	// Failures is the number of consecutive failed writes
+	Failures int
+	// Outstanding is the number of writes in progress
+	Outstanding int64
+}
+
+type backend struct {
+	address     string
+	conn        *TCPConn
+	lock        sync.Mutex
+	ejected     atomic.Bool
+	failures    int
+	outstanding atomic.Int64
+	// removed is set once the backend is no longer one of the destinations
+	removed bool
+	// redialing is set while a failed connection is being replaced, so the
+	// writers that fail on it in the meantime aren't counted again
+	redialing bool
+}
+
+type hashPoint struct {
+	hash    uint32
+	backend *backend
+}
+
+// Destination spreads writes across a set of backend addresses, ejecting those
+// that keep failing and readmitting them once they can be dialed again. It is
+// safe for concurrent use.
+type Destination struct {
+	name     string
+	cfg      DestinationConfig
+	lock     sync.RWMutex
+	backends []*backend
+	ring     []hashPoint
+	next     atomic.Uint64
+
+	readmitInterval time.Duration
+	closeChannel    chan struct{}
+	closeOnce       *sync.Once
+	closeGroup      *sync.WaitGroup
+}
+
+func newDestination(name string, cfg DestinationConfig) (*Destination, error) {
+	if cfg.EjectAfter == 0 {
+		cfg.EjectAfter = DefaultEjectAfter
+	}
+	if cfg.ReadmitInterval == 0 {
+		cfg.ReadmitInterval = DefaultReadmitInterval
+	}
+	if cfg.ResolveInterval == 0 {
+		cfg.ResolveInterval = DefaultResolveInterval
+	}
+	addresses := cfg.Addresses
+	if cfg.Resolver != nil {
+		var err error
+		if addresses, err = cfg.Resolver.Resolve(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	d := &Destination{
+		name:            name,
+		cfg:             cfg,
+		readmitInterval: cfg.ReadmitInterval,
+		closeChannel:    make(chan struct{}),
+		closeOnce:       &sync.Once{},
+		closeGroup:      &sync.WaitGroup{},
+	}
+	d.setAddresses(addresses)
+	d.closeGroup.Add(1)
+	go d.readmitLoop()
+	if cfg.Resolver != nil {
+		d.closeGroup.Add(1)
+		go d.resolveLoop()
+	}
+	return d, nil
+}
+
+// setAddresses reconciles the backends with addresses, dialing those that are
+// new and closing those that are gone. Backends that remain keep their
+// connection and health. Only one goroutine at a time may call it.
+func (d *Destination) setAddresses(addresses []string) {
+	d.lock.RLock()
+	current := make(map[string]*backend, len(d.backends))
+	for _, b := range d.backends {
+		current[b.address] = b
+	}
+	d.lock.RUnlock()
+
+	backends := make([]*backend, 0, len(addresses))
+	for _, address := range addresses {
+		if b, ok := current[address]; ok {
+			backends = append(backends, b)
+			delete(current, address)
+			continue
+		}
+		if containsBackend(backends, address) {
+			continue
+		}
+		backends = append(backends, d.dialBackend(address))
+	}
+
+	d.lock.Lock()
+	d.backends = backends
+	d.ring = buildRing(backends)
+	d.lock.Unlock()
+
+	// Whatever is left over is no longer part of the destination
+	for _, b := range current {
+		b.lock.Lock()
+		b.removed = true
+		b.ejected.Store(true)
+		if b.conn != nil {
+			b.conn.Close()
+			b.conn = nil
+		}
+		b.lock.Unlock()
+	}
+}
+
+func containsBackend(backends []*backend, address string) bool {
+	for _, b := range backends {
+		if b.address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveLoop calls the Resolver every ResolveInterval, and reconciles the
+// backends with the result
+func (d *Destination) resolveLoop() {
+	defer d.closeGroup.Done()
+	ticker := time.NewTicker(d.cfg.ResolveInterval)
+	defer ticker.Stop()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		// Abandon a lookup in progress when the destination is closed
+		<-d.closeChannel
+		cancel()
+	}()
+	for {
+		select {
+		case <-d.closeChannel:
+			return
+		case <-ticker.C:
+		}
+		addresses, err := d.cfg.Resolver.Resolve(ctx)
+		if err == nil && len(addresses) == 0 {
+			err = ErrNoAddresses
+		}
+		if err != nil {
+			if d.cfg.OnResolveError != nil && ctx.Err() == nil {
+				d.cfg.OnResolveError(err)
+			}
+			continue
+		}
+		d.setAddresses(addresses)
+	}
+}
+
+// dialBackend creates a backend for address. If it can't be dialed, it starts
+// out ejected, and is readmitted in the background.
+func (d *Destination) dialBackend(address string) *backend {
+	b := &backend{address: address}
+	cfg := d.cfg.Conn
+	cfg.Address = address
+	conn, err := DialTCP(&cfg)
+	if err != nil {
+		b.ejected.Store(true)
+		return b
+	}
+	b.conn = conn
+	return b
+}
+
+func buildRing(backends []*backend) []hashPoint {
+	ring := make([]hashPoint, 0, len(backends)*hashRingReplicas)
+	for _, b := range backends {
+		for i := 0; i < hashRingReplicas; i++ {
+			ring = append(ring, hashPoint{hash: hashKey(b.address + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+// Write sends data as a single message to one of the healthy backends, chosen
+// by the destinations Strategy. With BalanceConsistentHash, use WriteKey instead,
+// otherwise every write is treated as having an empty key.
+func (d *Destination) Write(data []byte) (int, error) {
+	return d.WriteKey("", data)
+}
+
+// WriteKey behaves like Write, but with BalanceConsistentHash every write with the
+// same key goes to the same backend. The key is ignored by the other strategies.
+// A failed write is not retried against another backend, as some of the message
+// may already have been sent.
+func (d *Destination) WriteKey(key string, data []byte) (int, error) {
+	b := d.pick(key)
+	if b == nil {
+		return 0, ErrNoHealthyBackends
+	}
+	b.outstanding.Add(1)
+	defer b.outstanding.Add(-1)
+
+	b.lock.Lock()
+	conn := b.conn
+	b.lock.Unlock()
+	if conn == nil {
+		return 0, ErrNoHealthyBackends
+	}
+	n, err := conn.Write(data)
+	d.record(b, conn, err)
+	return n, err
+}
+
+// record updates a backends health after a write over conn
+func (d *Destination) record(b *backend, conn *TCPConn, err error) {
+	if err != nil && !conn.brokenBy(err) {
+		// The message was refused before anything was sent, so the backend is fine
+		return
+	}
+	b.lock.Lock()
+	if err == nil {
+		b.failures = 0
+		b.lock.Unlock()
+		return
+	}
+	if b.conn != conn || b.removed || b.redialing {
+		// Another writer already replaced the connection that failed, or is
+		// replacing it, or the backend was removed from the destination
+		b.lock.Unlock()
+		return
+	}
+	b.failures++
+	if b.failures >= d.cfg.EjectAfter {
+		b.conn = nil
+		b.ejected.Store(true)
+		b.lock.Unlock()
+		conn.Close()
+		return
+	}
+	b.redialing = true
+	b.lock.Unlock()
+	conn.Close()
+	// The failed write closed the connection, so redial it for the next one.
+	// This happens in the background, so neither this writer nor those picking
+	// the backend in the meantime wait on the dial, they fail fast on the old
+	// connection instead
+	go d.redial(b, conn)
+}
+
+// redial replaces conn, the broken connection to b, or ejects b if it can't be
+// dialed
+func (d *Destination) redial(b *backend, conn *TCPConn) {
+	cfg := d.cfg.Conn
+	cfg.Address = b.address
+	replacement, dialErr := DialTCP(&cfg)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.redialing = false
+	closed := false
+	select {
+	case <-d.closeChannel:
+		closed = true
+	default:
+	}
+	if closed || b.removed || b.conn != conn {
+		// We raced a Close, or the backend was removed, so the new conn isn't wanted
+		if replacement != nil {
+			replacement.Close()
+		}
+		return
+	}
+	if dialErr != nil {
+		b.conn = nil
+		b.ejected.Store(true)
+		return
+	}
+	b.conn = replacement
+}
+
+// pick chooses a healthy backend, or returns nil if there are none
+func (d *Destination) pick(key string) *backend {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if len(d.backends) == 0 {
+		return nil
+	}
+	switch d.cfg.Strategy {
+	case BalanceConsistentHash:
+		h := hashKey(key)
+		start := sort.Search(len(d.ring), func(i int) bool { return d.ring[i].hash >= h })
+		// Walk clockwise past any ejected backends, so only their keys move
+		for i := 0; i < len(d.ring); i++ {
+			if b := d.ring[(start+i)%len(d.ring)].backend; !b.ejected.Load() {
+				return b
+			}
+		}
+		return nil
+	case BalanceRandom:
+		healthy := make([]*backend, 0, len(d.backends))
+		for _, b := range d.backends {
+			if !b.ejected.Load() {
+				healthy = append(healthy, b)
+			}
+		}
+		if len(healthy) == 0 {
+			return nil
+		}
+		return healthy[rand.IntN(len(healthy))]
+	}
+
+	start := int(d.next.Add(1) % uint64(len(d.backends)))
+	var best *backend
+	for i := range d.backends {
+		b := d.backends[(start+i)%len(d.backends)]
+		if b.ejected.Load() {
+			continue
+		}
+		if d.cfg.Strategy == BalanceRoundRobin {
+			return b
+		}
+		if best == nil || b.outstanding.Load() < best.outstanding.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+// readmitLoop redials ejected backends every readmitInterval
+func (d *Destination) readmitLoop() {
+	defer d.closeGroup.Done()
+	ticker := time.NewTicker(d.readmitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.closeChannel:
+			return
+		case <-ticker.C:
+		}
+		d.lock.RLock()
+		backends := d.backends
+		d.lock.RUnlock()
+		for _, b := range backends {
+			if b.ejected.Load() {
+				d.readmit(b)
+			}
+		}
+	}
+}
+
+func (d *Destination) readmit(b *backend) {
+	cfg := d.cfg.Conn
+	cfg.Address = b.address
+	conn, err := DialTCP(&cfg)
+	if err != nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	select {
+	case <-d.closeChannel:
+		// We raced a Close, so the new conn isn't wanted
+		conn.Close()
+		return
+	default:
+	}
+	if b.removed {
+		conn.Close()
+		return
+	}
+	b.conn = conn
+	b.failures = 0
+	b.ejected.Store(false)
+}
+
+// Health reports the state of every backend, in the order they were configured,
+// or returned by the Resolver.
+func (d *Destination) Health() []BackendHealth {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	health := make([]BackendHealth, 0, len(d.backends))
+	for _, b := range d.backends {
+		b.lock.Lock()
+		health = append(health, BackendHealth{
+			Address:     b.address,
+			Ejected:     b.ejected.Load(),
+			Failures:    b.failures,
+			Outstanding: b.outstanding.Load(),
+		})
+		b.lock.Unlock()
+	}
+	return health
+}
+
+// Close stops readmitting backends, and closes every backend connection.
+func (d *Destination) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.closeChannel)
+	})
+	d.closeGroup.Wait()
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	var firstErr error
+	for _, b := range d.backends {
+		b.lock.Lock()
+		b.ejected.Store(true)
+		if b.conn != nil {
+			if err := b.conn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+			b.conn = nil
+		}
+		b.lock.Unlock()
+	}
+	return firstErr
+}
@@ -0,0 +1,264 @@
+package buffstreams
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startCountingListener listens on port, counting the messages it receives
+func startCountingListener(t *testing.T, port int, count *atomic.Int32) *TCPListener {
+	cfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(port)),
+		Callback: func([]byte) error { count.Add(1); return nil },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	return l
+}
+
+// waitForCount polls count until it reaches at least want
+func waitForCount(t *testing.T, count *atomic.Int32, want int32) {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && count.Load() < want {
+		time.Sleep(time.Millisecond)
+	}
+	if got := count.Load(); got < want {
+		t.Fatalf("Expected atleast %d messages, actually got %d", want, got)
+	}
+}
+
+func TestDestinationBalancesAcrossBackends(t *testing.T) {
+	ports := []int{5049, 5050, 5051}
+	counts := make([]*atomic.Int32, len(ports))
+	var addresses []string
+	for i, port := range ports {
+		counts[i] = &atomic.Int32{}
+		l := startCountingListener(t, port, counts[i])
+		defer l.Close()
+		addresses = append(addresses, FormatAddress("127.0.0.1", strconv.Itoa(port)))
+	}
+
+	bm := NewManager()
+	if err := bm.AddDestination("consumers", DestinationConfig{Addresses: addresses}); err != nil {
+		t.Fatalf("Failed to add destination: %s", err)
+	}
+	defer bm.RemoveDestination("consumers")
+	if err := bm.AddDestination("consumers", DestinationConfig{Addresses: addresses}); err != ErrAlreadyOpened {
+		t.Errorf("Expected ErrAlreadyOpened, actually got %v", err)
+	}
+	for i := 0; i < 9; i++ {
+		if _, err := bm.WriteDestination("consumers", []byte("hi")); err != nil {
+			t.Fatalf("Expected write to succeed, actually got %s", err)
+		}
+	}
+	for _, count := range counts {
+		waitForCount(t, count, 3)
+	}
+
+	if _, err := bm.WriteDestination("nobody", []byte("hi")); err != ErrUnknownDestination {
+		t.Errorf("Expected ErrUnknownDestination, actually got %v", err)
+	}
+}
+
+func TestDestinationConsistentHash(t *testing.T) {
+	var backends []*backend
+	for _, address := range []string{"10.0.0.1:5031", "10.0.0.2:5031", "10.0.0.3:5031"} {
+		backends = append(backends, &backend{address: address})
+	}
+	d := &Destination{
+		cfg:      DestinationConfig{Strategy: BalanceConsistentHash},
+		backends: backends,
+		ring:     buildRing(backends),
+	}
+	assigned := make(map[string]*backend)
+	used := make(map[*backend]bool)
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		assigned[key] = d.pick(key)
+		used[assigned[key]] = true
+		if d.pick(key) != assigned[key] {
+			t.Fatalf("Expected %s to map to the same backend every time", key)
+		}
+	}
+	if len(used) != len(backends) {
+		t.Errorf("Expected keys to be spread over every backend, actually used %d", len(used))
+	}
+
+	// Ejecting a backend only moves the keys that were assigned to it
+	backends[0].ejected.Store(true)
+	for key, b := range assigned {
+		if got := d.pick(key); got == backends[0] || (b != backends[0] && got != b) {
+			t.Errorf("Expected %s to stay on %s, actually moved to %s", key, b.address, got.address)
+		}
+	}
+}
+
+func TestDestinationEjectsAndReadmitsBackends(t *testing.T) {
+	var healthyCount, failingCount atomic.Int32
+	healthy := startCountingListener(t, 5052, &healthyCount)
+	defer healthy.Close()
+	failing := startCountingListener(t, 5053, &failingCount)
+
+	bm := NewManager()
+	failingAddress := FormatAddress("127.0.0.1", strconv.Itoa(5053))
+	err := bm.AddDestination("consumers", DestinationConfig{
+		Addresses:       []string{FormatAddress("127.0.0.1", strconv.Itoa(5052)), failingAddress},
+		Strategy:        BalanceLeastOutstanding,
+		EjectAfter:      1,
+		ReadmitInterval: 10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to add destination: %s", err)
+	}
+	defer bm.RemoveDestination("consumers")
+
+	// Take the backend down, and keep writing until the failure is noticed
+	failing.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for !backendEjected(bm, failingAddress) && time.Now().Before(deadline) {
+		bm.WriteDestination("consumers", []byte("hi"))
+		time.Sleep(time.Millisecond)
+	}
+	if !backendEjected(bm, failingAddress) {
+		t.Fatalf("Expected %s to be ejected", failingAddress)
+	}
+	before := healthyCount.Load()
+	for i := 0; i < 5; i++ {
+		if _, err := bm.WriteDestination("consumers", []byte("hi")); err != nil {
+			t.Errorf("Expected writes to go to the healthy backend, actually got %s", err)
+		}
+	}
+	waitForCount(t, &healthyCount, before+5)
+
+	// Bring it back, and it should be readmitted
+	failing = startCountingListener(t, 5053, &failingCount)
+	defer failing.Close()
+	deadline = time.Now().Add(2 * time.Second)
+	for backendEjected(bm, failingAddress) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if backendEjected(bm, failingAddress) {
+		t.Fatalf("Expected %s to be readmitted", failingAddress)
+	}
+}
+
+func backendEjected(bm *Manager, address string) bool {
+	health, _ := bm.DestinationHealth("consumers")
+	for _, h := range health {
+		if h.Address == address {
+			return h.Ejected
+		}
+	}
+	return false
+}
+
+func TestDestinationKeepsBackendsThatRefuseAMessage(t *testing.T) {
+	var count atomic.Int32
+	l := startCountingListener(t, 5082, &count)
+	defer l.Close()
+
+	bm := NewManager()
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5082))
+	if err := bm.AddDestination("consumers", DestinationConfig{Addresses: []string{address}, EjectAfter: 1}); err != nil {
+		t.Fatalf("Failed to add destination: %s", err)
+	}
+	defer bm.RemoveDestination("consumers")
+	waitForConnections(t, l, 1)
+	for i := 0; i < 3; i++ {
+		if _, err := bm.WriteDestination("consumers", nil); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("Expected an empty message to be refused, actually got %v", err)
+		}
+	}
+	if backendEjected(bm, address) {
+		t.Errorf("Expected the backend to stay healthy")
+	}
+	if _, err := bm.WriteDestination("consumers", []byte("hi")); err != nil {
+		t.Errorf("Expected the write to succeed, actually got %s", err)
+	}
+	waitForCount(t, &count, 1)
+	if n := len(l.Connections()); n != 1 {
+		t.Errorf("Expected the backend to keep it's one connection, actually %d", n)
+	}
+}
+
+func TestDestinationReplacesBrokenConnections(t *testing.T) {
+	var count atomic.Int32
+	l := startCountingListener(t, 5084, &count)
+	defer l.Close()
+
+	bm := NewManager()
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5084))
+	if err := bm.AddDestination("consumers", DestinationConfig{Addresses: []string{address}, EjectAfter: 3}); err != nil {
+		t.Fatalf("Failed to add destination: %s", err)
+	}
+	defer bm.RemoveDestination("consumers")
+	l.Kick(waitForConnections(t, l, 1)[0].ID)
+
+	// Keep writing until the broken connection is noticed and replaced
+	deadline := time.Now().Add(2 * time.Second)
+	failed := false
+	for time.Now().Before(deadline) {
+		_, err := bm.WriteDestination("consumers", []byte("hi"))
+		if err != nil {
+			failed = true
+		} else if failed {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !failed || backendEjected(bm, address) {
+		t.Fatalf("Expected the broken connection to be replaced without ejecting the backend")
+	}
+	// The broken connection was closed, rather than left open alongside it's replacement
+	waitForConnections(t, l, 1)
+}
+
+func TestDestinationRedialsInTheBackground(t *testing.T) {
+	var count atomic.Int32
+	l := startCountingListener(t, 5088, &count)
+	defer l.Close()
+
+	var dials atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	bm := NewManager()
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5088))
+	err := bm.AddDestination("consumers", DestinationConfig{
+		Addresses:  []string{address},
+		EjectAfter: 3,
+		// Every dial after the first hangs, as it would for a blackholed backend
+		Conn: TCPConnConfig{OnDial: func(string, error) {
+			if dials.Add(1) > 1 {
+				select {
+				case <-release:
+				case <-time.After(time.Second):
+				}
+			}
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to add destination: %s", err)
+	}
+	defer bm.RemoveDestination("consumers")
+	l.Kick(waitForConnections(t, l, 1)[0].ID)
+
+	// Writes fail once the kick is noticed, without waiting on the redial
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && dials.Load() < 2 {
+		start := time.Now()
+		bm.WriteDestination("consumers", []byte("hi"))
+		if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+			t.Fatalf("Expected the write to return without waiting on the redial, actually took %s", elapsed)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if dials.Load() < 2 {
+		t.Fatalf("Expected the broken connection to be redialed")
+	}
+}
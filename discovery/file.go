@@ -0,0 +1,81 @@
+// Package discovery provides a buffstreams.Resolver that reads backend addresses
+// from a JSON or YAML file. It lives apart from buffstreams itself, so the core
+// library doesn't depend on a YAML parser.
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// file is the layout of the file, in either format, ie:
+//
+//	{"addresses": ["10.0.0.1:5031", "10.0.0.2:5031"]}
+//
+// or
+//
+//	addresses:
+//	  - 10.0.0.1:5031
+//	  - 10.0.0.2:5031
+type file struct {
+	Addresses []string `json:"addresses" yaml:"addresses"`
+}
+
+// FileResolver is a buffstreams.Resolver that reads addresses from a file.
+// Files ending in .yaml or .yml are parsed as YAML, anything else as JSON. The
+// file is watched by it's modification time and size, so it is only parsed
+// again after it changes. Replace it atomically, by writing a new file and
+// renaming it into place, so it is never read half written.
+type FileResolver struct {
+	path string
+
+	lock      sync.Mutex
+	modTime   time.Time
+	size      int64
+	addresses []string
+}
+
+// NewFileResolver creates a *FileResolver for the file at path
+func NewFileResolver(path string) *FileResolver {
+	return &FileResolver{path: path}
+}
+
+// Resolve implements buffstreams.Resolver. If the file can't be read or
+// parsed, the error is returned, and the Manager keeps the current backends.
+func (r *FileResolver) Resolve(ctx context.Context) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.addresses != nil && info.ModTime().Equal(r.modTime) && info.Size() == r.size {
+		return r.addresses, nil
+	}
+
+	b, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	switch filepath.Ext(r.path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &f)
+	default:
+		err = json.Unmarshal(b, &f)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.modTime, r.size, r.addresses = info.ModTime(), info.Size(), f.Addresses
+	if r.addresses == nil {
+		r.addresses = []string{}
+	}
+	return r.addresses, nil
+}
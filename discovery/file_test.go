@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// replaceFile writes contents to path via a rename, as the docs recommend
+func replaceFile(t *testing.T, path string, contents string) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(contents), 0644); err != nil {
+		t.Fatalf("Could not write %s: %s", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("Could not rename %s: %s", tmp, err)
+	}
+}
+
+func TestFileResolverFormats(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"backends.json": `{"addresses": ["10.0.0.1:5031", "10.0.0.2:5031"]}`,
+		"backends.yaml": "addresses:\n  - 10.0.0.1:5031\n  - 10.0.0.2:5031\n",
+	} {
+		path := filepath.Join(dir, name)
+		replaceFile(t, path, contents)
+		addresses, err := NewFileResolver(path).Resolve(context.Background())
+		if err != nil {
+			t.Fatalf("Expected %s to resolve, actually got %s", name, err)
+		}
+		if strings.Join(addresses, ",") != "10.0.0.1:5031,10.0.0.2:5031" {
+			t.Errorf("Expected both addresses from %s, actually got %v", name, addresses)
+		}
+	}
+}
+
+func TestFileResolverPicksUpChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "backends.yml")
+	replaceFile(t, path, "addresses: [10.0.0.1:5031]\n")
+	r := NewFileResolver(path)
+	addresses, err := r.Resolve(context.Background())
+	if err != nil || strings.Join(addresses, ",") != "10.0.0.1:5031" {
+		t.Fatalf("Expected the first address, actually got %v: %v", addresses, err)
+	}
+
+	replaceFile(t, path, "addresses: [10.0.0.1:5031, 10.0.0.2:5031]\n")
+	addresses, err = r.Resolve(context.Background())
+	if err != nil || strings.Join(addresses, ",") != "10.0.0.1:5031,10.0.0.2:5031" {
+		t.Errorf("Expected the updated addresses, actually got %v: %v", addresses, err)
+	}
+
+	replaceFile(t, path, "addresses: [not: closed\n")
+	if _, err := r.Resolve(context.Background()); err == nil {
+		t.Errorf("Expected a malformed file to return an error")
+	}
+	os.Remove(path)
+	if _, err := r.Resolve(context.Background()); err == nil {
+		t.Errorf("Expected a missing file to return an error")
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/StabbyCutyou/buffstreams
+
+go 1.22
+
+require (
+	github.com/golang/protobuf v1.3.5
+	gopkg.in/yaml.v3 v3.0.1
+)
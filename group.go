@@ -0,0 +1,142 @@
+package buffstreams
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrUnknownGroup is returned when a caller uses a group name that has not been
+// added to the Manager.
+var ErrUnknownGroup = errors.New("This group has not been added.")
+
+// ErrInvalidQuorum is returned by BroadcastQuorum when the quorum is less than 1,
+// or more than the number of addresses in the group.
+var ErrInvalidQuorum = errors.New("Quorum must be between 1 and the size of the group.")
+
+// ErrQuorumNotReached is returned by BroadcastQuorum when too many deliveries
+// failed for the quorum to be reached.
+var ErrQuorumNotReached = errors.New("Too few deliveries succeeded to reach a quorum.")
+
+// ErrDeliveryPending is the result BroadcastQuorum reports for an address whose
+// write had not finished when it returned. The write carries on regardless.
+var ErrDeliveryPending = errors.New("Delivery had not finished when the broadcast returned.")
+
+// AddGroup registers a named group of addresses, to be written to together with
+// Broadcast. Each address is written to as with Write, so it must be dialed, or
+// pooled, before it can receive a Broadcast.
+func (bm *Manager) AddGroup(name string, addresses ...string) error {
+	bm.groupLock.Lock()
+	defer bm.groupLock.Unlock()
+	if _, ok := bm.groups[name]; ok {
+		return ErrAlreadyOpened
+	}
+	members := make([]string, 0, len(addresses))
+	seen := make(map[string]bool, len(addresses))
+	for _, address := range addresses {
+		if !seen[address] {
+			seen[address] = true
+			members = append(members, address)
+		}
+	}
+	bm.groups[name] = members
+	return nil
+}
+
+// RemoveGroup forgets the named group. The connections to it's addresses are
+// left open.
+func (bm *Manager) RemoveGroup(name string) error {
+	bm.groupLock.Lock()
+	defer bm.groupLock.Unlock()
+	if _, ok := bm.groups[name]; !ok {
+		return ErrUnknownGroup
+	}
+	delete(bm.groups, name)
+	return nil
+}
+
+// Broadcast writes data to every address in the group concurrently, and waits
+// for every write to finish. The result map holds the outcome for each address,
+// which is nil if the write succeeded. The error is only set if the group is unknown.
+func (bm *Manager) Broadcast(group string, data []byte) (map[string]error, error) {
+	members, err := bm.groupMembers(group)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]error, len(members))
+	for result := range bm.broadcast(members, data) {
+		results[result.address] = result.err
+	}
+	return results, nil
+}
+
+// BroadcastQuorum writes data to every address in the group concurrently, but
+// returns as soon as quorum of the writes have succeeded, or enough have failed
+// that it can't be reached, in which case the error is ErrQuorumNotReached. Addresses
+// whose writes are still in progress are reported with ErrDeliveryPending. As
+// those writes carry on, data must not be modified after BroadcastQuorum returns.
+func (bm *Manager) BroadcastQuorum(group string, data []byte, quorum int) (map[string]error, error) {
+	members, err := bm.groupMembers(group)
+	if err != nil {
+		return nil, err
+	}
+	if quorum < 1 || quorum > len(members) {
+		return nil, ErrInvalidQuorum
+	}
+	results := make(map[string]error, len(members))
+	for _, address := range members {
+		results[address] = ErrDeliveryPending
+	}
+	succeeded, failed := 0, 0
+	for result := range bm.broadcast(members, data) {
+		results[result.address] = result.err
+		if result.err == nil {
+			succeeded++
+		} else {
+			failed++
+		}
+		if succeeded >= quorum {
+			return results, nil
+		}
+		if failed > len(members)-quorum {
+			return results, ErrQuorumNotReached
+		}
+	}
+	// Unreachable, as every write either succeeds or fails
+	return results, ErrQuorumNotReached
+}
+
+func (bm *Manager) groupMembers(group string) ([]string, error) {
+	bm.groupLock.RLock()
+	defer bm.groupLock.RUnlock()
+	members, ok := bm.groups[group]
+	if !ok {
+		return nil, ErrUnknownGroup
+	}
+	return members, nil
+}
+
+type deliveryResult struct {
+	address string
+	err     error
+}
+
+// broadcast writes data to every address concurrently, sending each outcome on
+// the returned channel as it finishes. The channel is closed after the last one,
+// and is buffered so the writes never block on a caller that stops reading.
+func (bm *Manager) broadcast(addresses []string, data []byte) <-chan deliveryResult {
+	results := make(chan deliveryResult, len(addresses))
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			_, err := bm.Write(address, data)
+			results <- deliveryResult{address: address, err: err}
+		}(address)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+	return results
+}
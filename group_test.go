@@ -0,0 +1,60 @@
+package buffstreams
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestManagerBroadcastToGroup(t *testing.T) {
+	var firstCount, secondCount atomic.Int32
+	first := startCountingListener(t, 5058, &firstCount)
+	defer first.Close()
+	second := startCountingListener(t, 5059, &secondCount)
+	defer second.Close()
+
+	bm := NewManager()
+	defer bm.CloseAll(context.Background())
+	firstAddress := FormatAddress("127.0.0.1", strconv.Itoa(5058))
+	secondAddress := FormatAddress("127.0.0.1", strconv.Itoa(5059))
+	// Never dialed, so every write to it fails
+	missingAddress := FormatAddress("127.0.0.1", strconv.Itoa(5060))
+	if err := bm.Dial(&TCPConnConfig{Address: firstAddress}); err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", firstAddress, err)
+	}
+	if err := bm.DialPool(&TCPConnConfig{Address: secondAddress}, PoolConfig{Size: 2}); err != nil {
+		t.Fatalf("Failed to open pool to %s: %s", secondAddress, err)
+	}
+	if err := bm.AddGroup("downstream", firstAddress, secondAddress, missingAddress, firstAddress); err != nil {
+		t.Fatalf("Failed to add group: %s", err)
+	}
+
+	results, err := bm.Broadcast("downstream", []byte("config"))
+	if err != nil {
+		t.Fatalf("Expected Broadcast to succeed, actually got %s", err)
+	}
+	if len(results) != 3 || results[firstAddress] != nil || results[secondAddress] != nil || results[missingAddress] != ErrNotOpened {
+		t.Errorf("Expected a result for each distinct address, actually got %v", results)
+	}
+	waitForCount(t, &firstCount, 1)
+	waitForCount(t, &secondCount, 1)
+
+	if _, err := bm.BroadcastQuorum("downstream", []byte("config"), 2); err != nil {
+		t.Errorf("Expected a quorum of 2, actually got %s", err)
+	}
+	results, err = bm.BroadcastQuorum("downstream", []byte("config"), 3)
+	if err != ErrQuorumNotReached || results[missingAddress] != ErrNotOpened {
+		t.Errorf("Expected ErrQuorumNotReached, actually got %v: %v", err, results)
+	}
+	if _, err := bm.BroadcastQuorum("downstream", []byte("config"), 4); err != ErrInvalidQuorum {
+		t.Errorf("Expected ErrInvalidQuorum, actually got %v", err)
+	}
+
+	if err := bm.RemoveGroup("downstream"); err != nil {
+		t.Errorf("Expected RemoveGroup to succeed, actually got %s", err)
+	}
+	if _, err := bm.Broadcast("downstream", []byte("config")); err != ErrUnknownGroup {
+		t.Errorf("Expected ErrUnknownGroup, actually got %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+package buffstreams
+
+import "context"
+
+// Headers are small key value attributes, such as a tenant ID or schema version,
+// sent alongside a message in the frame metadata. They require EnableMetadata
+// on both ends of the connection.
+type Headers map[string]string
+
+// ListenHeadersCallback is a variant of ListenCallback that also receives the
+// Headers sent with the message. Headers is nil if none were sent.
+type ListenHeadersCallback func(Headers, []byte) error
+
+// appendTo encodes the headers as metadata fields onto dst. Keys reserved for
+// describing how the message is protected are left out.
+func (h Headers) appendTo(dst []byte) []byte {
+	for key, value := range h {
+		if reservedMetadataKey(key) {
+			continue
+		}
+		dst = appendMetadataField(dst, key, value)
+	}
+	return dst
+}
+
+// parseHeaders decodes every field of a metadata section. Any propagated trace
+// context is included, under the traceparent key, but the fields added by a
+// KeyRing are not.
+func parseHeaders(metadata []byte) (Headers, error) {
+	var h Headers
+	err := rangeMetadata(metadata, func(key, value []byte) bool {
+		if reservedMetadataKey(string(key)) {
+			return true
+		}
+		if h == nil {
+			h = make(Headers)
+		}
+		h[string(key)] = string(value)
+		return true
+	})
+	return h, err
+}
+
+type headersKey struct{}
+
+// ContextWithHeaders returns a copy of ctx carrying h, to be sent by WriteContext.
+func ContextWithHeaders(ctx context.Context, h Headers) context.Context {
+	return context.WithValue(ctx, headersKey{}, h)
+}
+
+// HeadersFromContext returns the Headers carried by ctx. For a ContextCallback,
+// these are the Headers that were sent with the message.
+func HeadersFromContext(ctx context.Context) Headers {
+	h, _ := ctx.Value(headersKey{}).(Headers)
+	return h
+}
@@ -0,0 +1,116 @@
+package buffstreams
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeadersRoundTrip(t *testing.T) {
+	h := Headers{"tenant": "acme", "content-type": "application/x-protobuf", "empty": ""}
+	parsed, err := parseHeaders(h.appendTo(nil))
+	if err != nil {
+		t.Fatalf("Failed to parse headers: %s", err)
+	}
+	if len(parsed) != len(h) {
+		t.Errorf("Expected %d headers, actually got %v", len(h), parsed)
+	}
+	for k, v := range h {
+		if parsed[k] != v {
+			t.Errorf("Expected header %s to be %q, actually got %q", k, v, parsed[k])
+		}
+	}
+	if parsed, err := parseHeaders(nil); parsed != nil || err != nil {
+		t.Errorf("Expected no headers from empty metadata, actually got %v, %v", parsed, err)
+	}
+	md := h.appendTo(nil)
+	if _, err := parseHeaders(md[:len(md)-1]); err != ErrInvalidMetadata {
+		t.Errorf("Expected truncated metadata to be invalid, actually got %v", err)
+	}
+}
+
+func TestWriteWithHeaders(t *testing.T) {
+	type message struct {
+		headers Headers
+		data    string
+	}
+	received := make(chan message, 2)
+	cfg := TCPListenerConfig{
+		Address:        FormatAddress("", strconv.Itoa(5044)),
+		EnableMetadata: true,
+		MaxHeaderSize:  64,
+		HeadersCallback: func(h Headers, data []byte) error {
+			received <- message{h, string(data)}
+			return nil
+		},
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+
+	connCfg := TCPConnConfig{
+		Address:        FormatAddress("127.0.0.1", strconv.Itoa(5044)),
+		EnableMetadata: true,
+		MaxHeaderSize:  64,
+	}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+
+	if _, err := c.WriteWithHeaders(Headers{"tenant": strings.Repeat("x", 64)}, []byte("big")); err != ErrHeadersTooLarge {
+		t.Errorf("Expected ErrHeadersTooLarge, actually got %v", err)
+	}
+	if _, err := c.WriteWithHeaders(Headers{"tenant": "acme", "schema": "3"}, []byte("hello")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+	if _, err := c.Write([]byte("bare")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+	for _, expected := range []message{{Headers{"tenant": "acme", "schema": "3"}, "hello"}, {nil, "bare"}} {
+		select {
+		case m := <-received:
+			if m.data != expected.data || len(m.headers) != len(expected.headers) {
+				t.Errorf("Expected %+v, actually got %+v", expected, m)
+			}
+			for k, v := range expected.headers {
+				if m.headers[k] != v {
+					t.Errorf("Expected header %s to be %q, actually got %q", k, v, m.headers[k])
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected to receive %+v", expected)
+		}
+	}
+}
+
+func TestWriteWithHeadersRequiresMetadata(t *testing.T) {
+	if _, err := btc.WriteWithHeaders(Headers{"tenant": "acme"}, msgBytes); err != ErrMetadataDisabled {
+		t.Errorf("Expected ErrMetadataDisabled, actually got %v", err)
+	}
+	cfg := TCPConnConfig{Address: buffWriteConfig.Address, EnableMetadata: true, MaxHeaderSize: 1 << 16}
+	if _, err := DialTCP(&cfg); err != ErrInvalidMaxHeaderSize {
+		t.Errorf("Expected ErrInvalidMaxHeaderSize, actually got %v", err)
+	}
+}
+
+func TestHeadersWithSchema(t *testing.T) {
+	ref := SchemaRef{ID: "message.Note", Version: 2}
+	var none Headers
+	if got, ok := none.WithSchema(ref).Schema(); !ok || got != ref {
+		t.Errorf("Expected %s from nil Headers, actually got %s", ref, got)
+	}
+	h := Headers{"tenant": "acme"}
+	withSchema := h.WithSchema(ref)
+	if withSchema["tenant"] != "acme" {
+		t.Errorf("Expected the other headers to be kept, actually got %v", withSchema)
+	}
+	if _, ok := h.Schema(); ok {
+		t.Errorf("Expected the original headers to be left alone, actually got %v", h)
+	}
+}
@@ -0,0 +1,274 @@
+package buffstreams
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrUnknownKey is returned when a key ID is not in the KeyRing, either when
+	// selecting it, or when a message was protected with it.
+	ErrUnknownKey = errors.New("No key with this ID is in the KeyRing.")
+	// ErrDecryptionFailed is returned when reading a message that can't be
+	// decrypted, because it was tampered with or encrypted with a different key.
+	ErrDecryptionFailed = errors.New("Message could not be decrypted.")
+	// ErrInvalidSignature is returned when reading a message whose signature
+	// doesn't match it's contents.
+	ErrInvalidSignature = errors.New("Message signature is invalid.")
+	// ErrEncryptionRequired is returned when reading a message that isn't
+	// encrypted, if RequireEncryption is set.
+	ErrEncryptionRequired = errors.New("Message is not encrypted.")
+	// ErrSignatureRequired is returned when reading a message that isn't signed,
+	// if RequireSignature is set.
+	ErrSignatureRequired = errors.New("Message is not signed.")
+)
+
+// Metadata fields used to describe how a message is protected. The leading
+// colon keeps them apart from any application headers.
+const (
+	encryptionKeyKey = ":enc-key"
+	signingKeyKey    = ":sig-key"
+	signatureKey     = ":sig"
+)
+
+// reservedMetadataKey reports whether key is one of the fields above
+func reservedMetadataKey(key string) bool {
+	return key == encryptionKeyKey || key == signingKeyKey || key == signatureKey
+}
+
+// sealOverhead is how much larger a message is once encrypted, for the nonce
+// in front of it and the authentication tag behind it
+const sealOverhead = 12 + 16
+
+// KeyRing holds the keys a TCPConn or TCPListener uses to encrypt and sign the
+// messages it writes, and to decrypt and verify those it reads, by key ID. It
+// is safe for concurrent use, so keys can be rotated while connections are in
+// use: add the new key to every reader, switch the writers over to it, then
+// remove the old key once nothing is using it.
+//
+// Messages are encrypted with AES-GCM, with a random nonce each, so a key should
+// be rotated well before it has encrypted 2^32 messages. They are signed with
+// Ed25519, covering the payload as sent and the metadata before the signature.
+type KeyRing struct {
+	lock             *sync.RWMutex
+	encryptionKeys   map[string]cipher.AEAD
+	encryptionID     string
+	verificationKeys map[string]ed25519.PublicKey
+	signingID        string
+	signingKey       ed25519.PrivateKey
+}
+
+// NewKeyRing creates an empty *KeyRing, which neither encrypts nor signs.
+func NewKeyRing() *KeyRing {
+	return &KeyRing{
+		lock:             &sync.RWMutex{},
+		encryptionKeys:   make(map[string]cipher.AEAD),
+		verificationKeys: make(map[string]ed25519.PublicKey),
+	}
+}
+
+// AddEncryptionKey adds an AES key of 16, 24 or 32 bytes under id, for decrypting
+// messages. Use UseEncryptionKey to also encrypt with it.
+func (k *KeyRing) AddEncryptionKey(id string, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.encryptionKeys[id] = aead
+	return nil
+}
+
+// UseEncryptionKey encrypts every message written from now on with the key
+// added under id.
+func (k *KeyRing) UseEncryptionKey(id string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if _, ok := k.encryptionKeys[id]; !ok {
+		return ErrUnknownKey
+	}
+	k.encryptionID = id
+	return nil
+}
+
+// RemoveEncryptionKey forgets the key added under id. If messages were being
+// encrypted with it, they no longer are.
+func (k *KeyRing) RemoveEncryptionKey(id string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.encryptionKeys, id)
+	if k.encryptionID == id {
+		k.encryptionID = ""
+	}
+}
+
+// UseSigningKey signs every message written from now on with key, under id. The
+// readers must have the public half under the same id.
+func (k *KeyRing) UseSigningKey(id string, key ed25519.PrivateKey) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.signingID, k.signingKey = id, key
+}
+
+// StopSigning stops signing the messages written from now on.
+func (k *KeyRing) StopSigning() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.signingID, k.signingKey = "", nil
+}
+
+// AddVerificationKey adds a public key under id, for verifying messages signed
+// with it's private half.
+func (k *KeyRing) AddVerificationKey(id string, key ed25519.PublicKey) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.verificationKeys[id] = key
+}
+
+// RemoveVerificationKey forgets the public key added under id.
+func (k *KeyRing) RemoveVerificationKey(id string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	delete(k.verificationKeys, id)
+}
+
+// writeKeys returns the keys to protect an outgoing message with, which are nil
+// if it shouldn't be encrypted or signed
+func (k *KeyRing) writeKeys() (string, cipher.AEAD, string, ed25519.PrivateKey) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	var aead cipher.AEAD
+	if k.encryptionID != "" {
+		aead = k.encryptionKeys[k.encryptionID]
+	}
+	return k.encryptionID, aead, k.signingID, k.signingKey
+}
+
+// encryptionKey looks up a key for reading. A connection that requires
+// protection without a KeyRing has none to find.
+func (k *KeyRing) encryptionKey(id string) (cipher.AEAD, bool) {
+	if k == nil {
+		return nil, false
+	}
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	aead, ok := k.encryptionKeys[id]
+	return aead, ok
+}
+
+func (k *KeyRing) verificationKey(id string) (ed25519.PublicKey, bool) {
+	if k == nil {
+		return nil, false
+	}
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+	key, ok := k.verificationKeys[id]
+	return key, ok
+}
+
+// protect encrypts and signs an outgoing message, per the KeyRing, adding the
+// fields that describe how onto it's metadata. Must be called with the writeLock held
+func (c *TCPConn) protect(metadata []byte, data []byte) ([]byte, []byte, error) {
+	encryptionID, aead, signingID, signingKey := c.keys.writeKeys()
+	if aead != nil {
+		nonce := c.outgoingSealedBuffer[:aead.NonceSize()]
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, nil, err
+		}
+		data = aead.Seal(nonce, nonce, data, []byte(encryptionID))
+		metadata = appendMetadataField(metadata, encryptionKeyKey, encryptionID)
+	}
+	if signingKey != nil {
+		metadata = appendMetadataField(metadata, signingKeyKey, signingID)
+		c.outgoingSignedBuffer = append(append(c.outgoingSignedBuffer[:0], metadata[metadataLengthSize:]...), data...)
+		metadata = appendMetadataField(metadata, signatureKey, string(ed25519.Sign(signingKey, c.outgoingSignedBuffer)))
+	}
+	return metadata, data, nil
+}
+
+// protection describes how an incoming message was protected, from it's metadata
+type protection struct {
+	encryptionID []byte
+	signingID    []byte
+	signature    []byte
+	// signedLength is how much of the metadata the signature covers
+	signedLength int
+}
+
+// parseProtection finds the fields describing how a message was protected. The
+// signature must be the last field, as it covers those before it.
+func parseProtection(metadata []byte) (protection, error) {
+	var p protection
+	md := metadata
+	for len(md) > 0 {
+		start := len(metadata) - len(md)
+		key, rest, err := nextMetadataBytes(md)
+		if err != nil {
+			return p, err
+		}
+		value, rest, err := nextMetadataBytes(rest)
+		if err != nil {
+			return p, err
+		}
+		switch string(key) {
+		case encryptionKeyKey:
+			p.encryptionID = value
+		case signingKeyKey:
+			p.signingID = value
+		case signatureKey:
+			if len(rest) != 0 {
+				return p, ErrInvalidMetadata
+			}
+			p.signature, p.signedLength = value, start
+		}
+		md = rest
+	}
+	return p, nil
+}
+
+// unprotect verifies and decrypts an incoming message, per the KeyRing, leaving
+// the plain message in b. A payload that isn't encrypted was read straight into
+// b. Must be called with the readLock held
+func (c *TCPConn) unprotect(p protection, metadata []byte, payload []byte, b []byte) (int, error) {
+	if p.signature == nil {
+		if c.requireSignature {
+			return 0, ErrSignatureRequired
+		}
+	} else {
+		key, ok := c.keys.verificationKey(string(p.signingID))
+		if !ok {
+			return 0, ErrUnknownKey
+		}
+		c.incomingSignedBuffer = append(append(c.incomingSignedBuffer[:0], metadata[:p.signedLength]...), payload...)
+		if !ed25519.Verify(key, c.incomingSignedBuffer, p.signature) {
+			return 0, ErrInvalidSignature
+		}
+	}
+	if p.encryptionID == nil {
+		if c.requireEncryption {
+			return 0, ErrEncryptionRequired
+		}
+		return len(payload), nil
+	}
+	aead, ok := c.keys.encryptionKey(string(p.encryptionID))
+	if !ok {
+		return 0, ErrUnknownKey
+	}
+	if len(payload) < sealOverhead {
+		return 0, ErrDecryptionFailed
+	}
+	plain, err := aead.Open(b[:0], payload[:aead.NonceSize()], payload[aead.NonceSize():], p.encryptionID)
+	if err != nil {
+		return 0, ErrDecryptionFailed
+	}
+	return len(plain), nil
+}
@@ -0,0 +1,313 @@
+package buffstreams
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestKeys returns an AES key and an Ed25519 key pair
+func newTestKeys(t *testing.T) ([]byte, ed25519.PublicKey, ed25519.PrivateKey) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf("Failed to generate a key: %s", err)
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Failed to generate a key pair: %s", err)
+	}
+	return key, pub, priv
+}
+
+// protectedPair connects a TCPConn configured with writer to one configured
+// with reader
+func protectedPair(t *testing.T, writer *TCPConnConfig, reader *TCPConnConfig) (*TCPConn, *TCPConn) {
+	r, client := rawPair(t, reader)
+	w, err := newTCPConn(writer)
+	if err != nil {
+		t.Fatalf("Failed to create connection: %s", err)
+	}
+	w.socket = client
+	w.state = StateConnected
+	return w, r
+}
+
+// capture writes data over a TCPConn configured with cfg, returning the frame
+// as it was sent
+func capture(t *testing.T, cfg *TCPConnConfig, data []byte) []byte {
+	w, raw := rawPair(t, cfg)
+	defer raw.Close()
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Expected Write to succeed, actually got %s", err)
+	}
+	w.Close()
+	frame, err := io.ReadAll(raw)
+	if err != nil {
+		t.Fatalf("Failed to read the frame: %s", err)
+	}
+	return frame
+}
+
+func TestKeyRingSelectsOnlyKnownKeys(t *testing.T) {
+	ring := NewKeyRing()
+	if err := ring.AddEncryptionKey("k1", []byte("too short")); err == nil {
+		t.Errorf("Expected an AES key of the wrong length to be refused")
+	}
+	if err := ring.UseEncryptionKey("k1"); err != ErrUnknownKey {
+		t.Errorf("Expected ErrUnknownKey, actually got %v", err)
+	}
+	key, _, _ := newTestKeys(t)
+	ring.AddEncryptionKey("k1", key)
+	if err := ring.UseEncryptionKey("k1"); err != nil {
+		t.Errorf("Expected to use the added key, actually got %s", err)
+	}
+	ring.RemoveEncryptionKey("k1")
+	if id, aead, _, _ := ring.writeKeys(); id != "" || aead != nil {
+		t.Errorf("Expected removing the key in use to stop encrypting, actually using %s", id)
+	}
+}
+
+func TestProtectedMessagesRoundTrip(t *testing.T) {
+	key, pub, priv := newTestKeys(t)
+	writerRing := NewKeyRing()
+	writerRing.AddEncryptionKey("k1", key)
+	writerRing.UseEncryptionKey("k1")
+	writerRing.UseSigningKey("s1", priv)
+	readerRing := NewKeyRing()
+	readerRing.AddEncryptionKey("k1", key)
+	readerRing.AddVerificationKey("s1", pub)
+
+	writerCfg := &TCPConnConfig{MaxMessageSize: 64, EnableMetadata: true, MaxHeaderSize: 256, KeyRing: writerRing}
+	readerCfg := &TCPConnConfig{MaxMessageSize: 64, EnableMetadata: true, MaxHeaderSize: 256, KeyRing: readerRing,
+		RequireEncryption: true, RequireSignature: true}
+	w, r := protectedPair(t, writerCfg, readerCfg)
+	defer w.Close()
+	defer r.Close()
+
+	// A message of MaxMessageSize still fits, once sealed
+	payloads := [][]byte{[]byte("attack at dawn"), bytes.Repeat([]byte{'x'}, 64)}
+	buf := make([]byte, 64)
+	for _, payload := range payloads {
+		if _, err := w.WriteWithHeaders(Headers{"tenant": "acme"}, payload); err != nil {
+			t.Fatalf("Expected Write to succeed, actually got %s", err)
+		}
+		n, metadata, err := r.readMessage(buf)
+		if err != nil {
+			t.Fatalf("Expected Read to succeed, actually got %s", err)
+		}
+		if !bytes.Equal(buf[:n], payload) {
+			t.Errorf("Expected to read %q, actually read %q", payload, buf[:n])
+		}
+		headers, _ := parseHeaders(metadata)
+		if len(headers) != 1 || headers["tenant"] != "acme" {
+			t.Errorf("Expected only the application headers, actually got %v", headers)
+		}
+	}
+
+	if frame := capture(t, writerCfg, payloads[0]); bytes.Contains(frame, payloads[0]) {
+		t.Errorf("Expected the message to be encrypted on the wire")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	key1, pub1, priv1 := newTestKeys(t)
+	key2, pub2, priv2 := newTestKeys(t)
+	writerRing := NewKeyRing()
+	writerRing.AddEncryptionKey("k1", key1)
+	writerRing.UseEncryptionKey("k1")
+	writerRing.UseSigningKey("s1", priv1)
+	readerRing := NewKeyRing()
+	readerRing.AddEncryptionKey("k1", key1)
+	readerRing.AddVerificationKey("s1", pub1)
+
+	cfg := func(ring *KeyRing) *TCPConnConfig {
+		return &TCPConnConfig{MaxMessageSize: 64, EnableMetadata: true, MaxHeaderSize: 256, KeyRing: ring}
+	}
+	w, r := protectedPair(t, cfg(writerRing), cfg(readerRing))
+	defer w.Close()
+	defer r.Close()
+	buf := make([]byte, 64)
+	expectRead := func(want error) {
+		t.Helper()
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatalf("Expected Write to succeed, actually got %s", err)
+		}
+		if _, err := r.Read(buf); err != want {
+			t.Errorf("Expected Read to return %v, actually got %v", want, err)
+		}
+	}
+	expectRead(nil)
+
+	// The new keys reach the reader first, then the writer switches over
+	readerRing.AddEncryptionKey("k2", key2)
+	readerRing.AddVerificationKey("s2", pub2)
+	writerRing.AddEncryptionKey("k2", key2)
+	writerRing.UseEncryptionKey("k2")
+	writerRing.UseSigningKey("s2", priv2)
+	expectRead(nil)
+
+	readerRing.RemoveEncryptionKey("k1")
+	readerRing.RemoveVerificationKey("s1")
+	expectRead(nil)
+	writerRing.UseEncryptionKey("k1")
+	writerRing.UseSigningKey("s2", priv2)
+	expectRead(ErrUnknownKey)
+	writerRing.UseEncryptionKey("k2")
+	writerRing.UseSigningKey("s1", priv1)
+	expectRead(ErrUnknownKey)
+
+	// A rejected message doesn't disturb the stream
+	writerRing.UseSigningKey("s2", priv2)
+	expectRead(nil)
+}
+
+func TestTamperedMessagesAreRejected(t *testing.T) {
+	key, pub, priv := newTestKeys(t)
+	encrypting := NewKeyRing()
+	encrypting.AddEncryptionKey("k1", key)
+	encrypting.UseEncryptionKey("k1")
+	signing := NewKeyRing()
+	signing.UseSigningKey("s1", priv)
+	reading := NewKeyRing()
+	reading.AddEncryptionKey("k1", key)
+	reading.AddVerificationKey("s1", pub)
+
+	cfg := func(ring *KeyRing) *TCPConnConfig {
+		return &TCPConnConfig{MaxMessageSize: 64, EnableMetadata: true, MaxHeaderSize: 256, KeyRing: ring}
+	}
+	cases := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"encrypted", capture(t, cfg(encrypting), []byte("hello")), ErrDecryptionFailed},
+		{"signed", capture(t, cfg(signing), []byte("hello")), ErrInvalidSignature},
+	}
+	for _, c := range cases {
+		genuine := append([]byte(nil), c.frame...)
+		// Flip a bit of the payload, at the end of the frame
+		c.frame[len(c.frame)-1] ^= 1
+		r, client := rawPair(t, cfg(reading))
+		client.Write(c.frame)
+		client.Write(genuine)
+		buf := make([]byte, 64)
+		if _, err := r.Read(buf); err != c.want {
+			t.Errorf("Expected the tampered %s message to fail with %v, actually got %v", c.name, c.want, err)
+		}
+		if n, err := r.Read(buf); err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("Expected the genuine %s message to follow, actually got %q, %v", c.name, buf[:n], err)
+		}
+		client.Close()
+		r.Close()
+	}
+}
+
+func TestRequireProtection(t *testing.T) {
+	if _, err := newTCPConn(&TCPConnConfig{KeyRing: NewKeyRing()}); err != ErrMetadataDisabled {
+		t.Errorf("Expected ErrMetadataDisabled, actually got %v", err)
+	}
+	if _, err := ListenTCP(TCPListenerConfig{RequireSignature: true}); err != ErrMetadataDisabled {
+		t.Errorf("Expected ErrMetadataDisabled, actually got %v", err)
+	}
+
+	key, _, _ := newTestKeys(t)
+	encrypting := NewKeyRing()
+	encrypting.AddEncryptionKey("k1", key)
+	encrypting.UseEncryptionKey("k1")
+	cases := []struct {
+		writer *KeyRing
+		reader *TCPConnConfig
+		want   error
+	}{
+		{nil, &TCPConnConfig{EnableMetadata: true, RequireEncryption: true}, ErrEncryptionRequired},
+		{nil, &TCPConnConfig{EnableMetadata: true, RequireSignature: true}, ErrSignatureRequired},
+		{encrypting, &TCPConnConfig{EnableMetadata: true, RequireSignature: true}, ErrSignatureRequired},
+		// Without a KeyRing, there is no key to decrypt with
+		{encrypting, &TCPConnConfig{EnableMetadata: true, RequireEncryption: true}, ErrUnknownKey},
+	}
+	for i, c := range cases {
+		w, r := protectedPair(t, &TCPConnConfig{EnableMetadata: true, KeyRing: c.writer}, c.reader)
+		if _, err := w.Write([]byte("hello")); err != nil {
+			t.Fatalf("Expected Write to succeed, actually got %s", err)
+		}
+		if _, err := r.Read(make([]byte, DefaultMaxMessageSize)); err != c.want {
+			t.Errorf("Case %d: expected %v, actually got %v", i, c.want, err)
+		}
+		w.Close()
+		r.Close()
+	}
+}
+
+func TestListenerProtectedMessages(t *testing.T) {
+	key, pub, priv := newTestKeys(t)
+	clientRing := NewKeyRing()
+	clientRing.AddEncryptionKey("k1", key)
+	clientRing.UseEncryptionKey("k1")
+	clientRing.UseSigningKey("s1", priv)
+	listenerRing := NewKeyRing()
+	listenerRing.AddEncryptionKey("k1", key)
+	listenerRing.AddVerificationKey("s1", pub)
+
+	received := make(chan Headers, 10)
+	readErrors := make(chan error, 10)
+	cfg := TCPListenerConfig{
+		Address:          FormatAddress("", strconv.Itoa(5079)),
+		EnableMetadata:   true,
+		MaxHeaderSize:    256,
+		KeyRing:          listenerRing,
+		RequireSignature: true,
+		HeadersCallback: func(h Headers, data []byte) error {
+			if string(data) == "hello" {
+				received <- h
+			}
+			return nil
+		},
+		OnReadError: func(_ ConnectionInfo, err error) { readErrors <- err },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	defer l.Close()
+	l.StartListeningAsync()
+
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5079))
+	conn, err := DialTCP(&TCPConnConfig{Address: address, EnableMetadata: true, MaxHeaderSize: 256, KeyRing: clientRing})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer conn.Close()
+	if _, err := conn.WriteWithHeaders(Headers{"tenant": "acme"}, []byte("hello")); err != nil {
+		t.Fatalf("Expected Write to succeed, actually got %s", err)
+	}
+	select {
+	case h := <-received:
+		if len(h) != 1 || h["tenant"] != "acme" {
+			t.Errorf("Expected only the application headers, actually got %v", h)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the message to reach the Callback")
+	}
+
+	unsigned, err := DialTCP(&TCPConnConfig{Address: address, EnableMetadata: true, MaxHeaderSize: 256})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer unsigned.Close()
+	unsigned.Write([]byte("hello"))
+	select {
+	case err := <-readErrors:
+		if err != ErrSignatureRequired {
+			t.Errorf("Expected ErrSignatureRequired, actually got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the unsigned message to be refused")
+	}
+	if len(received) != 0 {
+		t.Errorf("Expected the unsigned message never to reach the Callback")
+	}
+}
@@ -0,0 +1,116 @@
+package buffstreams
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+)
+
+// logger is the libraries view of a configured slog.Handler. A nil *logger
+// discards everything, so a listener or conn without logging configured pays
+// only a nil check. Call sites on the hot path should still guard with enabled
+// before building their attributes, so that nothing is allocated when the
+// level is filtered out.
+type logger struct {
+	l *slog.Logger
+}
+
+// newLogger returns a logger for the provided handler. If no handler is set,
+// enableLogging falls back to the slog default, which writes via the log package.
+// As EnableLogging has only ever logged errors, the default is limited to
+// warnings and above, leaving the connection lifecycle events to those that
+// configure a Logger.
+func newLogger(h slog.Handler, enableLogging bool) *logger {
+	if h == nil {
+		if !enableLogging {
+			return nil
+		}
+		h = minLevelHandler{Handler: slog.Default().Handler(), level: slog.LevelWarn}
+	}
+	return &logger{l: slog.New(h)}
+}
+
+// minLevelHandler drops the events below level, before they reach the Handler
+type minLevelHandler struct {
+	slog.Handler
+	level slog.Level
+}
+
+func (h minLevelHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level && h.Handler.Enabled(ctx, level)
+}
+
+func (h minLevelHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return minLevelHandler{Handler: h.Handler.WithAttrs(attrs), level: h.level}
+}
+
+func (h minLevelHandler) WithGroup(name string) slog.Handler {
+	return minLevelHandler{Handler: h.Handler.WithGroup(name), level: h.level}
+}
+
+func (l *logger) enabled(level slog.Level) bool {
+	return l != nil && l.l.Enabled(context.Background(), level)
+}
+
+func (l *logger) log(level slog.Level, msg string, attrs ...slog.Attr) {
+	if !l.enabled(level) {
+		return
+	}
+	l.l.LogAttrs(context.Background(), level, msg, attrs...)
+}
+
+// connAttrs identifies an accepted connection in log events
+func connAttrs(info ConnectionInfo) slog.Attr {
+	if info.ProxyAddress != "" {
+		return slog.Group("conn",
+			slog.Uint64("id", info.ID),
+			slog.String("remote_addr", info.RemoteAddress),
+			slog.String("proxy_addr", info.ProxyAddress),
+		)
+	}
+	return slog.Group("conn",
+		slog.Uint64("id", info.ID),
+		slog.String("remote_addr", info.RemoteAddress),
+	)
+}
+
+// errAttrs describes an error, along with a coarse kind that is easy to filter
+// and aggregate on
+func errAttrs(err error) slog.Attr {
+	return slog.Group("error",
+		slog.String("kind", errorKind(err)),
+		slog.String("message", err.Error()),
+	)
+}
+
+// errorKind classifies the errors the library runs into while reading and writing
+func errorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case err == io.EOF:
+		return "eof"
+	case errors.Is(err, net.ErrClosed) || err == ErrConnectionClosed:
+		return "closed"
+	case err == ErrZeroBytesReadHeader || err == ErrLessThanZeroBytesReadHeader:
+		return "header"
+	case err == ErrRateLimited:
+		return "rate_limited"
+	case errors.Is(err, ErrMessageTooLarge):
+		return "size"
+	case err == ErrReadTooSlow:
+		return "slow"
+	case err == ErrFrameTimeout:
+		return "timeout"
+	case err == ErrUnknownKey || err == ErrDecryptionFailed || err == ErrInvalidSignature ||
+		err == ErrEncryptionRequired || err == ErrSignatureRequired:
+		return "protection"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &netErr):
+		return "network"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,120 @@
+package buffstreams
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer lets the test read what the listener goroutines are logging
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) events() []map[string]interface{} {
+	b.Lock()
+	defer b.Unlock()
+	var events []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(b.buf.Bytes()))
+	for {
+		event := map[string]interface{}{}
+		if err := dec.Decode(&event); err != nil {
+			return events
+		}
+		events = append(events, event)
+	}
+}
+
+func TestEnableLoggingOnlyLogsWarnings(t *testing.T) {
+	l := newLogger(nil, true)
+	if l.enabled(slog.LevelInfo) || !l.enabled(slog.LevelWarn) || !l.enabled(slog.LevelError) {
+		t.Errorf("Expected EnableLogging to only log warnings and errors to the default logger")
+	}
+	if newLogger(nil, false) != nil {
+		t.Errorf("Expected nothing to be logged without EnableLogging or a Logger")
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind string
+	}{
+		{io.EOF, "eof"},
+		{net.ErrClosed, "closed"},
+		{ErrZeroBytesReadHeader, "header"},
+		{ErrInvalidSignature, "protection"},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, "network"},
+		{errors.New("bad message"), "other"},
+	}
+	for _, c := range cases {
+		if kind := errorKind(c.err); kind != c.kind {
+			t.Errorf("Error kind incorrect. For %v, got %s, expected %s", c.err, kind, c.kind)
+		}
+	}
+}
+
+func TestNewLoggerIsNilWhenDisabled(t *testing.T) {
+	if l := newLogger(nil, false); l != nil {
+		t.Errorf("Expected no logger when logging is disabled, actually got %v", l)
+	}
+	if l := newLogger(nil, true); l == nil {
+		t.Errorf("Expected EnableLogging to fall back to the default logger")
+	}
+}
+
+func TestListenerLogsStructuredEvents(t *testing.T) {
+	out := &lockedBuffer{}
+	cfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(5041)),
+		Callback: func([]byte) error { return errors.New("bad message") },
+		Logger:   slog.NewJSONHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5041))}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, event := range out.events() {
+			if event["msg"] != "callback failed" {
+				continue
+			}
+			conn, _ := event["conn"].(map[string]interface{})
+			errGroup, _ := event["error"].(map[string]interface{})
+			if event["level"] != "WARN" || conn["id"] == nil || conn["remote_addr"] != c.socket.LocalAddr().String() ||
+				errGroup["kind"] != "other" || errGroup["message"] != "bad message" {
+				t.Errorf("Expected a structured callback failure event, actually got %v", event)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected a callback failure to be logged, actually got %v", out.events())
+}
@@ -1,8 +1,12 @@
 package buffstreams
 
 import (
+	"context"
 	"errors"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ErrAlreadyOpened represents the error where a caller has tried to open the same
@@ -13,6 +17,9 @@ var ErrAlreadyOpened = errors.New("A connection to this ip / port is already ope
 // an address that they have not opened yet.
 var ErrNotOpened = errors.New("A connection to this ip / port must be opened first.")
 
+// ErrManagerShutdown is returned when a Manager is used after Shutdown has been called.
+var ErrManagerShutdown = errors.New("The manager has been shut down.")
+
 // Manager represents the object used to govern interactions between tcp endpoints.
 // You can use it to read from and write to streaming or non-streaming TCP connections
 // and have it handle packaging data with a header describing the size of the data payload.
@@ -20,18 +27,65 @@ var ErrNotOpened = errors.New("A connection to this ip / port must be opened fir
 // a custom-delimeter situation to be sent in a streaming fashion.
 type Manager struct {
 	dialedConnections map[string]*TCPConn
+	dialedPools       map[string]*ConnPool
 	listeningSockets  map[string]*TCPListener
+	destinations      map[string]*Destination
+	groups            map[string][]string
 	dialerLock        *sync.RWMutex
 	listenerLock      *sync.Mutex
+	destinationLock   *sync.RWMutex
+	groupLock         *sync.RWMutex
+
+	// Auto dialing, see autodial.go. The autoDialed map is guarded by the
+	// dialerLock, along with dialedConnections
+	autoDialConfig *AutoDialConfig
+	autoDialLock   *sync.Mutex
+	dialing        map[string]*dialCall
+	autoDialed     map[string]*atomic.Int64
+	evictorStop    chan struct{}
+
+	// Shutdown waits on the writeGroup for Writes in flight to finish
+	shutdown     bool
+	shutdownLock *sync.RWMutex
+	writeGroup   *sync.WaitGroup
+}
+
+// WriterInfo describes a connection, or pool of connections, dialed by a Manager.
+type WriterInfo struct {
+	Address string
+	// ConnectedAt is when the connection was last opened. It is zero for a pool.
+	ConnectedAt time.Time
+	// State is where the connection is in it's lifecycle. For a pool, see
+	// Pool instead.
+	State ConnState
+	// Pool is the health of the pool, if the address was dialed with DialPool
+	Pool *PoolHealth
+}
+
+// ListenerInfo describes a listener started by a Manager.
+type ListenerInfo struct {
+	Address string
+	// Connections are the clients currently connected
+	Connections []ConnectionInfo
 }
 
 // NewManager creates a new *Manager based on the provided ManagerConfig
 func NewManager() *Manager {
 	bm := &Manager{
 		dialedConnections: make(map[string]*TCPConn),
+		dialedPools:       make(map[string]*ConnPool),
 		listeningSockets:  make(map[string]*TCPListener),
+		destinations:      make(map[string]*Destination),
+		groups:            make(map[string][]string),
 		dialerLock:        &sync.RWMutex{},
 		listenerLock:      &sync.Mutex{},
+		destinationLock:   &sync.RWMutex{},
+		groupLock:         &sync.RWMutex{},
+		autoDialLock:      &sync.Mutex{},
+		dialing:           make(map[string]*dialCall),
+		autoDialed:        make(map[string]*atomic.Int64),
+		shutdownLock:      &sync.RWMutex{},
+		writeGroup:        &sync.WaitGroup{},
 	}
 	return bm
 }
@@ -52,6 +106,9 @@ func (bm *Manager) StartListening(cfg TCPListenerConfig) error {
 
 	bm.listenerLock.Lock()
 	defer bm.listenerLock.Unlock()
+	if bm.isShutdown() {
+		return ErrManagerShutdown
+	}
 	if _, ok := bm.listeningSockets[cfg.Address]; ok == true {
 		return ErrAlreadyOpened
 	}
@@ -66,18 +123,71 @@ func (bm *Manager) StartListening(cfg TCPListenerConfig) error {
 }
 
 // CloseListener lets you send a signal to a TCPListener that tells it to
-// stop accepting new requests. It will finish any requests in flight.
+// stop accepting new requests. It will finish any requests in flight. The
+// address may then be listened on again.
 func (bm *Manager) CloseListener(address string) error {
 	bm.listenerLock.Lock()
 	defer bm.listenerLock.Unlock()
 	if btl, ok := bm.listeningSockets[address]; ok == true {
 		btl.Close()
+		delete(bm.listeningSockets, address)
 		return nil
 	}
 	// If it wasn't opened, we hit this condition - return error
 	return ErrNotOpened
 }
 
+// ListenerConfig returns the configuration the listener at address is currently
+// running with, to be modified and passed to ReloadListener.
+func (bm *Manager) ListenerConfig(address string) (TCPListenerConfig, error) {
+	bm.listenerLock.Lock()
+	defer bm.listenerLock.Unlock()
+	btl, ok := bm.listeningSockets[address]
+	if !ok {
+		return TCPListenerConfig{}, ErrNotOpened
+	}
+	return btl.Config(), nil
+}
+
+// ReloadListener reconfigures the listener at address without dropping the port.
+// If cfg.Address is empty or unchanged, the listener is reloaded in place, as
+// with TCPListener.Reload. Otherwise it is rebound: a new listener is started on
+// cfg.Address first, so both accept connections during the switch, then the old
+// one is shut down, with it's connections given until ctx expires to drain. From
+// then on the Manager knows the listener by it's new address. If the new address
+// can't be listened on, the old listener is left running, and the error returned.
+func (bm *Manager) ReloadListener(ctx context.Context, address string, cfg TCPListenerConfig) error {
+	bm.listenerLock.Lock()
+	btl, ok := bm.listeningSockets[address]
+	if !ok {
+		bm.listenerLock.Unlock()
+		return ErrNotOpened
+	}
+	if cfg.Address == "" || cfg.Address == address {
+		bm.listenerLock.Unlock()
+		return btl.Reload(cfg)
+	}
+	if bm.isShutdown() {
+		bm.listenerLock.Unlock()
+		return ErrManagerShutdown
+	}
+	if _, ok := bm.listeningSockets[cfg.Address]; ok {
+		bm.listenerLock.Unlock()
+		return ErrAlreadyOpened
+	}
+	replacement, err := ListenTCP(cfg)
+	if err != nil {
+		bm.listenerLock.Unlock()
+		return err
+	}
+	replacement.StartListeningAsync()
+	bm.listeningSockets[cfg.Address] = replacement
+	delete(bm.listeningSockets, address)
+	bm.listenerLock.Unlock()
+
+	return btl.Shutdown(ctx)
+}
+
 // Dial must be called before attempting to write. This is because the TCPWriter
 // need certain configuration information, which should be provided upfront. Once
 // the connection is open, there should be no need to check on it's status. WriteTo
@@ -89,7 +199,11 @@ func (bm *Manager) CloseListener(address string) error {
 func (bm *Manager) Dial(cfg *TCPConnConfig) error {
 	bm.dialerLock.Lock()
 	defer bm.dialerLock.Unlock()
-	if _, ok := bm.dialedConnections[cfg.Address]; ok {
+	// Checked under the lock, so nothing is added once Shutdown has closed everything
+	if bm.isShutdown() {
+		return ErrManagerShutdown
+	}
+	if bm.isDialed(cfg.Address) {
 		return ErrAlreadyOpened
 	}
 
@@ -101,14 +215,63 @@ func (bm *Manager) Dial(cfg *TCPConnConfig) error {
 	return nil
 }
 
+// DialPool is an alternative to Dial, which opens a ConnPool of several connections
+// to the address, rather than a single one. Writes to the address are then spread
+// across the pool according to it's Strategy, rather than all serializing on one
+// connection, and broken connections are replaced in the background.
+func (bm *Manager) DialPool(cfg *TCPConnConfig, pcfg PoolConfig) error {
+	bm.dialerLock.Lock()
+	defer bm.dialerLock.Unlock()
+	if bm.isShutdown() {
+		return ErrManagerShutdown
+	}
+	if bm.isDialed(cfg.Address) {
+		return ErrAlreadyOpened
+	}
+
+	pool, err := DialPool(cfg, pcfg)
+	if err != nil {
+		return err
+	}
+	bm.dialedPools[cfg.Address] = pool
+	return nil
+}
+
+// isDialed must be called while holding the dialerLock
+func (bm *Manager) isDialed(address string) bool {
+	if _, ok := bm.dialedConnections[address]; ok {
+		return true
+	}
+	_, ok := bm.dialedPools[address]
+	return ok
+}
+
+// PoolHealth reports the health of the pool opened to address by DialPool.
+func (bm *Manager) PoolHealth(address string) (PoolHealth, error) {
+	bm.dialerLock.RLock()
+	pool, ok := bm.dialedPools[address]
+	bm.dialerLock.RUnlock()
+	if !ok {
+		return PoolHealth{}, ErrNotOpened
+	}
+	return pool.Health(), nil
+}
+
 // CloseWriter lets you send a signal to a TCPWriter that tells it to
-// stop accepting new requests. It will finish any requests in flight.
+// stop accepting new requests. It will finish any requests in flight. The
+// address may then be dialed again.
 func (bm *Manager) CloseWriter(address string) error {
 	bm.dialerLock.Lock()
 	defer bm.dialerLock.Unlock()
 	if btw, ok := bm.dialedConnections[address]; ok == true {
+		delete(bm.dialedConnections, address)
+		delete(bm.autoDialed, address)
 		return btw.Close()
 	}
+	if pool, ok := bm.dialedPools[address]; ok {
+		delete(bm.dialedPools, address)
+		return pool.Close()
+	}
 	// If it wasn't opened, we hit this condition - return error
 	return ErrNotOpened
 }
@@ -116,21 +279,297 @@ func (bm *Manager) CloseWriter(address string) error {
 // Write allows you to dial to a remote or local TCP endpoint, and send a series of
 // bytes as messages. Each array of bytes you pass in will be pre-pended with it's size
 // within the size of the pre-defined maximum message size. If the connection isn't open yet,
-// WriteTo will open it, and cache it. If for anyreason the connection breaks, it will be disposed
-// a. If not all bytes can be written,
-// WriteTo will keep trying until the full message is delivered, or the connection is broken.
+// Write will return ErrNotOpened, unless EnableAutoDial has been called, in which case it
+// will open it, and cache it. If for anyreason the connection breaks, it will be reopened
+// for the next Write. If not all bytes can be written,
+// Write will keep trying until the full message is delivered, or the connection is broken.
 func (bm *Manager) Write(address string, data []byte) (int, error) {
+	if !bm.beginWrite() {
+		return 0, ErrManagerShutdown
+	}
+	defer bm.writeGroup.Done()
 	// Get the connection if it's cached, or open a new one
-	bm.dialerLock.RLock()
-	btw, ok := bm.dialedConnections[address]
-	bm.dialerLock.RUnlock()
+	btw, pool, ok := bm.writerFor(address)
 	if !ok {
-		return 0, ErrNotOpened
+		if err := bm.autoDial(address); err != nil {
+			return 0, err
+		}
+		if btw, pool, ok = bm.writerFor(address); !ok {
+			// It was closed again before we got to use it
+			return 0, ErrNotOpened
+		}
+	}
+	if pool != nil {
+		// The pool replaces broken connections itself
+		return pool.Write(data)
 	}
 	bytesWritten, err := btw.Write(data)
 	if err != nil {
-		btw.Reopen()
-
+		bm.reconnect(address, btw)
 	}
 	return bytesWritten, err
 }
+
+// reconnect replaces the broken socket of a connection a Write failed on. Every
+// writer that failed on it ends up here, but only the first replaces it. A
+// connection that was closed and forgotten while the Write was in flight is
+// left closed, as nothing would ever close it again.
+func (bm *Manager) reconnect(address string, btw *TCPConn) {
+	bm.dialerLock.RLock()
+	current, ok := bm.dialedConnections[address]
+	tracked := ok && current == btw && !bm.isShutdown()
+	bm.dialerLock.RUnlock()
+	// Anything closing it from here on closes it explicitly, which reconnect
+	// respects
+	if tracked {
+		btw.reconnect()
+	}
+}
+
+// writerFor looks up the connection or pool dialed to address, marking it as
+// recently used if it was auto dialed
+func (bm *Manager) writerFor(address string) (*TCPConn, *ConnPool, bool) {
+	bm.dialerLock.RLock()
+	defer bm.dialerLock.RUnlock()
+	if pool, ok := bm.dialedPools[address]; ok {
+		return nil, pool, true
+	}
+	btw, ok := bm.dialedConnections[address]
+	if lastWrite, auto := bm.autoDialed[address]; auto {
+		lastWrite.Store(time.Now().UnixNano())
+	}
+	return btw, nil, ok
+}
+
+// AddDestination registers a logical destination under name, which spreads writes
+// across the backends at cfg.Addresses. Each backend is dialed right away. Those
+// that can't be reached start out ejected, and are readmitted once they can be.
+// If cfg.Resolver is set, it is called for the addresses instead, and it's error
+// is returned if that fails. Write to it with WriteDestination, or WriteDestinationKey.
+func (bm *Manager) AddDestination(name string, cfg DestinationConfig) error {
+	bm.destinationLock.Lock()
+	defer bm.destinationLock.Unlock()
+	if bm.isShutdown() {
+		return ErrManagerShutdown
+	}
+	if _, ok := bm.destinations[name]; ok {
+		return ErrAlreadyOpened
+	}
+	d, err := newDestination(name, cfg)
+	if err != nil {
+		return err
+	}
+	bm.destinations[name] = d
+	return nil
+}
+
+// RemoveDestination closes every backend connection of the destination, and
+// forgets it.
+func (bm *Manager) RemoveDestination(name string) error {
+	bm.destinationLock.Lock()
+	d, ok := bm.destinations[name]
+	delete(bm.destinations, name)
+	bm.destinationLock.Unlock()
+	if !ok {
+		return ErrUnknownDestination
+	}
+	return d.Close()
+}
+
+// WriteDestination sends data as a single message to one of the healthy backends
+// of the named destination, chosen by it's Strategy. A backend is ejected after
+// EjectAfter consecutive failed writes.
+func (bm *Manager) WriteDestination(name string, data []byte) (int, error) {
+	return bm.WriteDestinationKey(name, "", data)
+}
+
+// WriteDestinationKey behaves like WriteDestination, but when the destination
+// uses BalanceConsistentHash, every message with the same key goes to the same
+// backend.
+func (bm *Manager) WriteDestinationKey(name string, key string, data []byte) (int, error) {
+	if !bm.beginWrite() {
+		return 0, ErrManagerShutdown
+	}
+	defer bm.writeGroup.Done()
+	bm.destinationLock.RLock()
+	d, ok := bm.destinations[name]
+	bm.destinationLock.RUnlock()
+	if !ok {
+		return 0, ErrUnknownDestination
+	}
+	return d.WriteKey(key, data)
+}
+
+// DestinationHealth reports the state of every backend of the named destination.
+func (bm *Manager) DestinationHealth(name string) ([]BackendHealth, error) {
+	bm.destinationLock.RLock()
+	d, ok := bm.destinations[name]
+	bm.destinationLock.RUnlock()
+	if !ok {
+		return nil, ErrUnknownDestination
+	}
+	return d.Health(), nil
+}
+
+// Snapshot returns the measurements recorded for every listener and dialed
+// connection the Manager holds, keyed by address. Only those configured with
+// Metrics that implement MetricsSnapshotter are included.
+func (bm *Manager) Snapshot() map[string]MetricsSnapshot {
+	snapshots := make(map[string]MetricsSnapshot)
+	bm.listenerLock.Lock()
+	for address, btl := range bm.listeningSockets {
+		if _, ok := btl.metrics.(MetricsSnapshotter); ok {
+			snapshots[address] = btl.Snapshot()
+		}
+	}
+	bm.listenerLock.Unlock()
+
+	bm.dialerLock.RLock()
+	for address, btc := range bm.dialedConnections {
+		if _, ok := btc.metrics.(MetricsSnapshotter); ok {
+			snapshots[address] = snapshotOf(btc.metrics, address)
+		}
+	}
+	for address, pool := range bm.dialedPools {
+		if _, ok := pool.cfg.Metrics.(MetricsSnapshotter); ok {
+			snapshots[address] = snapshotOf(pool.cfg.Metrics, address)
+		}
+	}
+	bm.dialerLock.RUnlock()
+	return snapshots
+}
+
+// ListConnections describes every connection and pool the Manager has dialed,
+// ordered by address.
+func (bm *Manager) ListConnections() []WriterInfo {
+	bm.dialerLock.RLock()
+	infos := make([]WriterInfo, 0, len(bm.dialedConnections)+len(bm.dialedPools))
+	for address, btc := range bm.dialedConnections {
+		infos = append(infos, WriterInfo{Address: address, ConnectedAt: btc.connectedTime(), State: btc.State()})
+	}
+	for address, pool := range bm.dialedPools {
+		health := pool.Health()
+		infos = append(infos, WriterInfo{Address: address, Pool: &health})
+	}
+	bm.dialerLock.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Address < infos[j].Address })
+	return infos
+}
+
+// ListListeners describes every listener the Manager has started, and the
+// clients connected to it, ordered by address.
+func (bm *Manager) ListListeners() []ListenerInfo {
+	bm.listenerLock.Lock()
+	infos := make([]ListenerInfo, 0, len(bm.listeningSockets))
+	for address, btl := range bm.listeningSockets {
+		infos = append(infos, ListenerInfo{Address: address, Connections: btl.Connections()})
+	}
+	bm.listenerLock.Unlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Address < infos[j].Address })
+	return infos
+}
+
+// CloseAll closes every connection, pool and destination the Manager has dialed,
+// and shuts down every listener, letting their connections drain until ctx
+// expires. Everything is forgotten, so the Manager can be reused. It returns the
+// first error encountered, or ctx's error if the listeners didn't drain in time.
+func (bm *Manager) CloseAll(ctx context.Context) error {
+	var lock sync.Mutex
+	var firstErr error
+	record := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// Listeners drain concurrently, so they share the deadline rather than queue for it
+	bm.listenerLock.Lock()
+	listeners := bm.listeningSockets
+	bm.listeningSockets = make(map[string]*TCPListener)
+	bm.listenerLock.Unlock()
+	var wg sync.WaitGroup
+	for _, btl := range listeners {
+		wg.Add(1)
+		go func(btl *TCPListener) {
+			defer wg.Done()
+			record(btl.Shutdown(ctx))
+		}(btl)
+	}
+
+	bm.dialerLock.Lock()
+	for _, btc := range bm.dialedConnections {
+		record(btc.Close())
+	}
+	for _, pool := range bm.dialedPools {
+		record(pool.Close())
+	}
+	bm.dialedConnections = make(map[string]*TCPConn)
+	bm.dialedPools = make(map[string]*ConnPool)
+	bm.autoDialed = make(map[string]*atomic.Int64)
+	bm.dialerLock.Unlock()
+
+	bm.destinationLock.Lock()
+	for _, d := range bm.destinations {
+		record(d.Close())
+	}
+	bm.destinations = make(map[string]*Destination)
+	bm.destinationLock.Unlock()
+
+	wg.Wait()
+	return firstErr
+}
+
+// Shutdown gracefully stops the Manager. New Writes, Dials and listeners are
+// refused with ErrManagerShutdown, then Writes already in flight are given until
+// ctx expires to finish, before everything is closed as with CloseAll. The
+// Manager can't be used afterwards.
+func (bm *Manager) Shutdown(ctx context.Context) error {
+	bm.shutdownLock.Lock()
+	bm.shutdown = true
+	bm.shutdownLock.Unlock()
+
+	bm.autoDialLock.Lock()
+	if bm.evictorStop != nil {
+		close(bm.evictorStop)
+		bm.evictorStop = nil
+	}
+	bm.autoDialLock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		bm.writeGroup.Wait()
+		close(drained)
+	}()
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		// Out of time, closing the connections will cut the stragglers off
+		err = ctx.Err()
+	}
+	if closeErr := bm.CloseAll(ctx); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (bm *Manager) isShutdown() bool {
+	bm.shutdownLock.RLock()
+	defer bm.shutdownLock.RUnlock()
+	return bm.shutdown
+}
+
+// beginWrite registers a Write in flight, unless the Manager is shut down. The
+// registration happens under the shutdownLock, so Shutdown can't start waiting
+// on the writeGroup while it's being added to.
+func (bm *Manager) beginWrite() bool {
+	bm.shutdownLock.RLock()
+	defer bm.shutdownLock.RUnlock()
+	if bm.shutdown {
+		return false
+	}
+	bm.writeGroup.Add(1)
+	return true
+}
@@ -0,0 +1,368 @@
+package buffstreams
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManagerListsAndForgetsClosedEntries(t *testing.T) {
+	bm := NewManager()
+	listenCfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(5056)),
+		Callback: func([]byte) error { return nil },
+	}
+	if err := bm.StartListening(listenCfg); err != nil {
+		t.Fatalf("Could not Listen on %s: %s", listenCfg.Address, err)
+	}
+	connCfg := &TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5056))}
+	if err := bm.Dial(connCfg); err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+
+	writers := bm.ListConnections()
+	if len(writers) != 1 || writers[0].Address != connCfg.Address || writers[0].ConnectedAt.IsZero() ||
+		writers[0].State != StateConnected || writers[0].Pool != nil {
+		t.Errorf("Expected the dialed connection to be listed, actually got %+v", writers)
+	}
+	deadline := time.Now().Add(time.Second)
+	var listeners []ListenerInfo
+	for time.Now().Before(deadline) {
+		listeners = bm.ListListeners()
+		if len(listeners) == 1 && len(listeners[0].Connections) == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(listeners) != 1 || listeners[0].Address != listenCfg.Address || len(listeners[0].Connections) != 1 {
+		t.Errorf("Expected the listener and it's client to be listed, actually got %+v", listeners)
+	}
+
+	// A connection that went away is listed as such until it's forgotten
+	bm.dialedConnections[connCfg.Address].Close()
+	if writers := bm.ListConnections(); len(writers) != 1 || writers[0].State != StateClosed {
+		t.Errorf("Expected the closed connection to be listed as closed, actually got %+v", writers)
+	}
+
+	// Closed entries are forgotten, so they can be opened again
+	if err := bm.CloseWriter(connCfg.Address); err != nil {
+		t.Errorf("Expected CloseWriter to succeed, actually got %s", err)
+	}
+	if err := bm.CloseListener(listenCfg.Address); err != nil {
+		t.Errorf("Expected CloseListener to succeed, actually got %s", err)
+	}
+	if len(bm.ListConnections()) != 0 || len(bm.ListListeners()) != 0 {
+		t.Errorf("Expected closed entries to be removed")
+	}
+	if _, err := bm.Write(connCfg.Address, []byte("hi")); err != ErrNotOpened {
+		t.Errorf("Expected ErrNotOpened, actually got %v", err)
+	}
+	if err := bm.StartListening(listenCfg); err != nil {
+		t.Fatalf("Expected to listen again, actually got %s", err)
+	}
+	if err := bm.Dial(connCfg); err != nil {
+		t.Fatalf("Expected to dial again, actually got %s", err)
+	}
+	if _, err := bm.Write(connCfg.Address, []byte("hi")); err != nil {
+		t.Errorf("Expected write to succeed, actually got %s", err)
+	}
+
+	if err := bm.CloseAll(context.Background()); err != nil {
+		t.Errorf("Expected CloseAll to succeed, actually got %s", err)
+	}
+	if len(bm.ListConnections()) != 0 || len(bm.ListListeners()) != 0 {
+		t.Errorf("Expected CloseAll to remove every entry")
+	}
+	if err := bm.StartListening(listenCfg); err != nil {
+		t.Fatalf("Expected to listen after CloseAll, actually got %s", err)
+	}
+	bm.CloseAll(context.Background())
+}
+
+func TestManagerShutdownDrainsListenersAndRefusesWork(t *testing.T) {
+	var handled atomic.Int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	bm := NewManager()
+	listenCfg := TCPListenerConfig{
+		Address: FormatAddress("", strconv.Itoa(5057)),
+		Callback: func([]byte) error {
+			close(started)
+			<-release
+			handled.Add(1)
+			return nil
+		},
+	}
+	if err := bm.StartListening(listenCfg); err != nil {
+		t.Fatalf("Could not Listen on %s: %s", listenCfg.Address, err)
+	}
+	connCfg := &TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5057))}
+	if err := bm.Dial(connCfg); err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	if _, err := bm.Write(connCfg.Address, []byte("hi")); err != nil {
+		t.Fatalf("Expected write to succeed, actually got %s", err)
+	}
+
+	<-started
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		done <- bm.Shutdown(ctx)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected Shutdown to drain cleanly, actually got %s", err)
+	}
+	if handled.Load() != 1 {
+		t.Errorf("Expected the in flight message to be handled, actually got %d", handled.Load())
+	}
+
+	if _, err := bm.Write(connCfg.Address, []byte("hi")); err != ErrManagerShutdown {
+		t.Errorf("Expected ErrManagerShutdown from Write, actually got %v", err)
+	}
+	if err := bm.Dial(connCfg); err != ErrManagerShutdown {
+		t.Errorf("Expected ErrManagerShutdown from Dial, actually got %v", err)
+	}
+	if err := bm.StartListening(listenCfg); err != ErrManagerShutdown {
+		t.Errorf("Expected ErrManagerShutdown from StartListening, actually got %v", err)
+	}
+}
+
+func TestManagerReloadListenerRebindsWithOverlap(t *testing.T) {
+	bm := NewManager()
+	defer bm.CloseAll(context.Background())
+	oldAddress := FormatAddress("", strconv.Itoa(5062))
+	newAddress := FormatAddress("", strconv.Itoa(5063))
+	received := make(chan string, 4)
+	err := bm.StartListening(TCPListenerConfig{
+		Address:  oldAddress,
+		Callback: func(data []byte) error { received <- "old"; return nil },
+	})
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", oldAddress, err)
+	}
+
+	cfg, err := bm.ListenerConfig(oldAddress)
+	if err != nil {
+		t.Fatalf("Expected the listener config, actually got %s", err)
+	}
+	cfg.Address = newAddress
+	cfg.Callback = func(data []byte) error { received <- "new"; return nil }
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := bm.ReloadListener(ctx, oldAddress, cfg); err != nil {
+		t.Fatalf("Expected the listener to rebind, actually got %s", err)
+	}
+
+	listeners := bm.ListListeners()
+	if len(listeners) != 1 || listeners[0].Address != newAddress {
+		t.Errorf("Expected only the new address to be listed, actually got %+v", listeners)
+	}
+	if _, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5062))}); err == nil {
+		t.Errorf("Expected the old address to be released")
+	}
+	c, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5063))})
+	if err != nil {
+		t.Fatalf("Failed to open connection to the new address: %s", err)
+	}
+	defer c.Close()
+	c.Write([]byte("hi"))
+	if got := <-received; got != "new" {
+		t.Errorf("Expected the new callback, actually got %s", got)
+	}
+
+	if err := bm.ReloadListener(ctx, oldAddress, cfg); err != ErrNotOpened {
+		t.Errorf("Expected ErrNotOpened, actually got %v", err)
+	}
+}
+
+func TestManagerAutoDialWithTinyIdleTimeout(t *testing.T) {
+	bm := NewManager()
+	defer bm.CloseAll(context.Background())
+	// Any positive timeout is valid, however short
+	bm.EnableAutoDial(AutoDialConfig{IdleTimeout: time.Nanosecond})
+	time.Sleep(5 * time.Millisecond)
+	bm.EnableAutoDial(AutoDialConfig{})
+}
+
+func TestManagerAutoDial(t *testing.T) {
+	var accepted atomic.Int32
+	cfg := TCPListenerConfig{
+		Address:   FormatAddress("", strconv.Itoa(5064)),
+		Callback:  func([]byte) error { return nil },
+		OnConnect: func(ConnectionInfo) { accepted.Add(1) },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	var bigReceived atomic.Int32
+	bigCfg := TCPListenerConfig{
+		Address:        FormatAddress("", strconv.Itoa(5065)),
+		MaxMessageSize: 65536,
+		Callback:       func([]byte) error { bigReceived.Add(1); return nil },
+	}
+	big, err := ListenTCP(bigCfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", bigCfg.Address, err)
+	}
+	big.StartListeningAsync()
+	defer big.Close()
+
+	bm := NewManager()
+	defer bm.CloseAll(context.Background())
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5064))
+	bigAddress := FormatAddress("127.0.0.1", strconv.Itoa(5065))
+	bm.EnableAutoDial(AutoDialConfig{
+		Overrides:   map[string]TCPConnConfig{bigAddress: {MaxMessageSize: 65536}},
+		IdleTimeout: 50 * time.Millisecond,
+	})
+
+	// Concurrent first writes share a single dial
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := bm.Write(address, []byte("hi"))
+			errs <- err
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Expected auto dialed write to succeed, actually got %s", err)
+		}
+	}
+	waitForCount(t, &accepted, 1)
+	if accepted.Load() != 1 {
+		t.Errorf("Expected a single dial, actually got %d", accepted.Load())
+	}
+
+	// Overrides replace the template for their address
+	if _, err := bm.Write(bigAddress, make([]byte, 10000)); err != nil {
+		t.Errorf("Expected the override to allow a large message, actually got %s", err)
+	}
+	waitForCount(t, &bigReceived, 1)
+
+	// Once idle, the connections are closed, and dialed again on the next write
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) && len(bm.ListConnections()) != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if writers := bm.ListConnections(); len(writers) != 0 {
+		t.Errorf("Expected idle connections to be evicted, actually got %+v", writers)
+	}
+	waitForConnections(t, l, 0)
+	if _, err := bm.Write(address, []byte("hi")); err != nil {
+		t.Errorf("Expected the write to dial again, actually got %s", err)
+	}
+	waitForCount(t, &accepted, 2)
+}
+
+// startStalledPeer accepts connections but never reads from them, so writes to
+// it block once the socket buffers fill. It counts the connections accepted.
+func startStalledPeer(t *testing.T, accepted *atomic.Int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not Listen: %s", err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			defer c.Close()
+		}
+	}()
+	return l
+}
+
+// writeUntilBlocked writes to address from a goroutine until a Write fails,
+// returning once a Write has been blocked for a while
+func writeUntilBlocked(bm *Manager, address string) chan error {
+	done := make(chan error, 1)
+	data := make([]byte, 1<<20)
+	var writes atomic.Int32
+	go func() {
+		for {
+			if _, err := bm.Write(address, data); err != nil {
+				done <- err
+				return
+			}
+			writes.Add(1)
+		}
+	}()
+	for last := int32(-1); last != writes.Load(); {
+		last = writes.Load()
+		time.Sleep(100 * time.Millisecond)
+	}
+	return done
+}
+
+func TestManagerShutdownDoesNotReviveInFlightWrites(t *testing.T) {
+	var accepted atomic.Int32
+	peer := startStalledPeer(t, &accepted)
+	defer peer.Close()
+
+	bm := NewManager()
+	cfg := &TCPConnConfig{Address: peer.Addr().String(), MaxMessageSize: 1 << 20}
+	if err := bm.Dial(cfg); err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", cfg.Address, err)
+	}
+	conn, _, _ := bm.writerFor(cfg.Address)
+	done := writeUntilBlocked(bm, cfg.Address)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := bm.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to run out of time on the blocked Write, actually got %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Shutdown to cut off the blocked Write")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if state := conn.State(); state != StateClosed || accepted.Load() != 1 {
+		t.Errorf("Expected the connection to stay closed, actually %s with %d dials", state, accepted.Load())
+	}
+}
+
+func TestManagerEvictsIdleConnectionDuringSlowWrite(t *testing.T) {
+	var accepted atomic.Int32
+	peer := startStalledPeer(t, &accepted)
+	defer peer.Close()
+
+	bm := NewManager()
+	defer bm.CloseAll(context.Background())
+	bm.EnableAutoDial(AutoDialConfig{
+		Template:    TCPConnConfig{MaxMessageSize: 1 << 20},
+		IdleTimeout: 300 * time.Millisecond,
+	})
+	address := peer.Addr().String()
+	if _, err := bm.Write(address, []byte("hello")); err != nil {
+		t.Fatalf("Expected the first Write to dial, actually got %s", err)
+	}
+	conn, _, _ := bm.writerFor(address)
+	done := writeUntilBlocked(bm, address)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected evicting the connection to cut off the blocked Write")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if state := conn.State(); state != StateClosed || accepted.Load() != 1 {
+		t.Errorf("Expected the evicted connection to stay closed, actually %s with %d dials", state, accepted.Load())
+	}
+	if infos := bm.ListConnections(); len(infos) != 0 {
+		t.Errorf("Expected nothing to be tracked, actually got %+v", infos)
+	}
+}
@@ -0,0 +1,60 @@
+package buffstreams
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// ErrInvalidMetadata is returned when the metadata section of an incoming frame
+// is larger than the frame itself or MaxMetadataSize, or can't be parsed.
+var ErrInvalidMetadata = errors.New("Frame metadata is malformed. Connection Closed")
+
+// metadataLengthSize is the number of bytes used for the length of the metadata
+// section, which immediately follows the size header when metadata is enabled
+const metadataLengthSize = 2
+
+// When EnableMetadata is set, every frame carries a metadata section between
+// the size header and the payload:
+//
+//	| size header | metadata length (2 bytes, big endian) | metadata | payload |
+//
+// The size header covers everything after it. The metadata itself is a series
+// of fields, each a uvarint length prefixed key followed by a uvarint length
+// prefixed value. A frame without any metadata has a length of 0.
+
+// appendMetadataField encodes a single key value field onto dst
+func appendMetadataField(dst []byte, key string, value string) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(key)))
+	dst = append(dst, key...)
+	dst = binary.AppendUvarint(dst, uint64(len(value)))
+	return append(dst, value...)
+}
+
+// rangeMetadata invokes fn with each field of an encoded metadata section, in
+// order, until fn returns false. The key and value slices alias md.
+func rangeMetadata(md []byte, fn func(key, value []byte) bool) error {
+	for len(md) > 0 {
+		key, rest, err := nextMetadataBytes(md)
+		if err != nil {
+			return err
+		}
+		value, rest, err := nextMetadataBytes(rest)
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			return nil
+		}
+		md = rest
+	}
+	return nil
+}
+
+func nextMetadataBytes(md []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(md)
+	if n <= 0 || length > uint64(len(md)-n) {
+		return nil, nil, ErrInvalidMetadata
+	}
+	end := n + int(length)
+	return md[n:end], md[end:], nil
+}
@@ -0,0 +1,301 @@
+package buffstreams
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics receives measurements from TCPConns and TCPListeners. Every call is
+// labeled with the address of the endpoint: the listening address for a
+// TCPListener and the connections it accepts, or the remote address for a
+// dialed TCPConn. Implementations must be safe for concurrent use, and should
+// be cheap, as most methods are called once per message.
+type Metrics interface {
+	// MessageRead records a message of size payload bytes being read
+	MessageRead(address string, size int)
+	// MessageWritten records a message of size payload bytes being written
+	MessageWritten(address string, size int)
+	// ReadError records a failed read, with a coarse kind such as "eof" or "timeout"
+	ReadError(address string, kind string)
+	// WriteError records a failed write, with a coarse kind such as "closed" or "network"
+	WriteError(address string, kind string)
+	// CallbackDuration records how long a TCPListeners Callback took to run
+	CallbackDuration(address string, d time.Duration)
+	// ConnectionOpened records a connection being accepted or dialed
+	ConnectionOpened(address string)
+	// ConnectionClosed records a connection that was previously opened being closed
+	ConnectionClosed(address string)
+	// Reconnected records a successful TCPConn Reopen
+	Reconnected(address string)
+	// Throttled records a message that exceeded a TCPListeners rate limits, with
+	// the action taken, such as "delay" or "drop"
+	Throttled(address string, action string)
+	// ConnectionRejected records a connection a TCPListener refused to serve,
+	// with a coarse reason such as "max_connections" or "denied"
+	ConnectionRejected(address string, reason string)
+}
+
+// MetricsSnapshotter is implemented by Metrics that can report what they have
+// recorded. TCPListener.Snapshot and Manager.Snapshot rely on it.
+type MetricsSnapshotter interface {
+	Snapshot(address string) MetricsSnapshot
+}
+
+// MetricsSnapshot is a point in time copy of the measurements for one address.
+type MetricsSnapshot struct {
+	MessagesIn        uint64
+	MessagesOut       uint64
+	BytesIn           uint64
+	BytesOut          uint64
+	ReadErrors        map[string]uint64
+	WriteErrors       map[string]uint64
+	ActiveConnections int64
+	Reconnects        uint64
+	// Throttled counts the messages that exceeded a rate limit, by the action taken
+	Throttled map[string]uint64
+	// Rejected counts the connections refused by admission control, by reason
+	Rejected map[string]uint64
+	// FrameSizes is measured in payload bytes, for messages in both directions
+	FrameSizes Histogram
+	// CallbackLatency is measured in seconds
+	CallbackLatency Histogram
+}
+
+// Histogram is a point in time copy of a set of observations, grouped into buckets.
+type Histogram struct {
+	// Bounds are the inclusive upper bounds of each bucket, in ascending order
+	Bounds []float64
+	// Counts holds the number of observations in each bucket. It has one more
+	// entry than Bounds, for the observations larger than the last bound
+	Counts []uint64
+	// Count is the total number of observations
+	Count uint64
+	// Sum is the total of all observed values
+	Sum float64
+}
+
+var (
+	// DefaultFrameSizeBuckets are the bucket bounds, in bytes, used for frame sizes
+	DefaultFrameSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+	// DefaultLatencyBuckets are the bucket bounds, in seconds, used for callback latency
+	DefaultLatencyBuckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+)
+
+// InMemoryMetrics is a Metrics implementation that keeps counters and histograms
+// in memory, per address. A single InMemoryMetrics can be shared by any number
+// of TCPConns and TCPListeners.
+type InMemoryMetrics struct {
+	// Maps address to *endpointMetrics. Addresses are only ever added, so after
+	// the first message from an endpoint, every lookup is a lock free read
+	endpoints sync.Map
+}
+
+// NewInMemoryMetrics creates an empty *InMemoryMetrics
+func NewInMemoryMetrics() *InMemoryMetrics {
+	return &InMemoryMetrics{}
+}
+
+type endpointMetrics struct {
+	messagesIn        atomic.Uint64
+	messagesOut       atomic.Uint64
+	bytesIn           atomic.Uint64
+	bytesOut          atomic.Uint64
+	activeConnections atomic.Int64
+	reconnects        atomic.Uint64
+	frameSizes        *histogram
+	callbackLatency   *histogram
+
+	// Errors are rare, so they can afford a lock
+	errorLock   sync.Mutex
+	readErrors  map[string]uint64
+	writeErrors map[string]uint64
+	throttled   map[string]uint64
+	rejected    map[string]uint64
+}
+
+func (m *InMemoryMetrics) endpoint(address string) *endpointMetrics {
+	if e, ok := m.endpoints.Load(address); ok {
+		return e.(*endpointMetrics)
+	}
+	e, _ := m.endpoints.LoadOrStore(address, &endpointMetrics{
+		frameSizes:      newHistogram(DefaultFrameSizeBuckets),
+		callbackLatency: newHistogram(DefaultLatencyBuckets),
+		readErrors:      make(map[string]uint64),
+		writeErrors:     make(map[string]uint64),
+		throttled:       make(map[string]uint64),
+		rejected:        make(map[string]uint64),
+	})
+	return e.(*endpointMetrics)
+}
+
+// MessageRead implements Metrics
+func (m *InMemoryMetrics) MessageRead(address string, size int) {
+	e := m.endpoint(address)
+	e.messagesIn.Add(1)
+	e.bytesIn.Add(uint64(size))
+	e.frameSizes.observe(float64(size))
+}
+
+// MessageWritten implements Metrics
+func (m *InMemoryMetrics) MessageWritten(address string, size int) {
+	e := m.endpoint(address)
+	e.messagesOut.Add(1)
+	e.bytesOut.Add(uint64(size))
+	e.frameSizes.observe(float64(size))
+}
+
+// ReadError implements Metrics
+func (m *InMemoryMetrics) ReadError(address string, kind string) {
+	e := m.endpoint(address)
+	e.errorLock.Lock()
+	e.readErrors[kind]++
+	e.errorLock.Unlock()
+}
+
+// WriteError implements Metrics
+func (m *InMemoryMetrics) WriteError(address string, kind string) {
+	e := m.endpoint(address)
+	e.errorLock.Lock()
+	e.writeErrors[kind]++
+	e.errorLock.Unlock()
+}
+
+// CallbackDuration implements Metrics
+func (m *InMemoryMetrics) CallbackDuration(address string, d time.Duration) {
+	m.endpoint(address).callbackLatency.observe(d.Seconds())
+}
+
+// ConnectionOpened implements Metrics
+func (m *InMemoryMetrics) ConnectionOpened(address string) {
+	m.endpoint(address).activeConnections.Add(1)
+}
+
+// ConnectionClosed implements Metrics
+func (m *InMemoryMetrics) ConnectionClosed(address string) {
+	m.endpoint(address).activeConnections.Add(-1)
+}
+
+// Reconnected implements Metrics
+func (m *InMemoryMetrics) Reconnected(address string) {
+	m.endpoint(address).reconnects.Add(1)
+}
+
+// Throttled implements Metrics
+func (m *InMemoryMetrics) Throttled(address string, action string) {
+	e := m.endpoint(address)
+	e.errorLock.Lock()
+	e.throttled[action]++
+	e.errorLock.Unlock()
+}
+
+// ConnectionRejected implements Metrics
+func (m *InMemoryMetrics) ConnectionRejected(address string, reason string) {
+	e := m.endpoint(address)
+	e.errorLock.Lock()
+	e.rejected[reason]++
+	e.errorLock.Unlock()
+}
+
+// Snapshot implements MetricsSnapshotter. An address that has recorded nothing
+// returns an empty snapshot.
+func (m *InMemoryMetrics) Snapshot(address string) MetricsSnapshot {
+	if e, ok := m.endpoints.Load(address); ok {
+		return e.(*endpointMetrics).snapshot()
+	}
+	return MetricsSnapshot{}
+}
+
+// Snapshots returns a snapshot for every address that has recorded anything,
+// keyed by address.
+func (m *InMemoryMetrics) Snapshots() map[string]MetricsSnapshot {
+	snapshots := make(map[string]MetricsSnapshot)
+	m.endpoints.Range(func(address, e interface{}) bool {
+		snapshots[address.(string)] = e.(*endpointMetrics).snapshot()
+		return true
+	})
+	return snapshots
+}
+
+func (e *endpointMetrics) snapshot() MetricsSnapshot {
+	s := MetricsSnapshot{
+		MessagesIn:        e.messagesIn.Load(),
+		MessagesOut:       e.messagesOut.Load(),
+		BytesIn:           e.bytesIn.Load(),
+		BytesOut:          e.bytesOut.Load(),
+		ActiveConnections: e.activeConnections.Load(),
+		Reconnects:        e.reconnects.Load(),
+		FrameSizes:        e.frameSizes.snapshot(),
+		CallbackLatency:   e.callbackLatency.snapshot(),
+		ReadErrors:        make(map[string]uint64),
+		WriteErrors:       make(map[string]uint64),
+		Throttled:         make(map[string]uint64),
+		Rejected:          make(map[string]uint64),
+	}
+	e.errorLock.Lock()
+	defer e.errorLock.Unlock()
+	for kind, count := range e.readErrors {
+		s.ReadErrors[kind] = count
+	}
+	for kind, count := range e.writeErrors {
+		s.WriteErrors[kind] = count
+	}
+	for action, count := range e.throttled {
+		s.Throttled[action] = count
+	}
+	for reason, count := range e.rejected {
+		s.Rejected[reason] = count
+	}
+	return s
+}
+
+// histogram is a lock free, fixed bucket histogram
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	// The bits of a float64, so the sum can be updated atomically
+	sum atomic.Uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot() Histogram {
+	s := Histogram{
+		Bounds: append([]float64(nil), h.bounds...),
+		Counts: make([]uint64, len(h.counts)),
+		Count:  h.count.Load(),
+		Sum:    math.Float64frombits(h.sum.Load()),
+	}
+	for i := range h.counts {
+		s.Counts[i] = h.counts[i].Load()
+	}
+	return s
+}
+
+// snapshotOf returns the snapshot for an address, if the Metrics support it
+func snapshotOf(m Metrics, address string) MetricsSnapshot {
+	if s, ok := m.(MetricsSnapshotter); ok {
+		return s.Snapshot(address)
+	}
+	return MetricsSnapshot{}
+}
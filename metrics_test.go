@@ -0,0 +1,88 @@
+package buffstreams
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	h := newHistogram([]float64{1, 10, 100})
+	for _, v := range []float64{0.5, 1, 5, 50, 500, 5000} {
+		h.observe(v)
+	}
+	s := h.snapshot()
+	expected := []uint64{2, 1, 1, 2}
+	for i, count := range expected {
+		if s.Counts[i] != count {
+			t.Errorf("Bucket %d incorrect. Got %d, expected %d", i, s.Counts[i], count)
+		}
+	}
+	if s.Count != 6 || s.Sum != 5556.5 {
+		t.Errorf("Expected count 6 and sum 5556.5, actually got %d and %v", s.Count, s.Sum)
+	}
+}
+
+// waitForSnapshot polls until the snapshot matches, returning the last one seen
+func waitForSnapshot(snapshot func() MetricsSnapshot, done func(MetricsSnapshot) bool) MetricsSnapshot {
+	deadline := time.Now().Add(time.Second)
+	s := snapshot()
+	for !done(s) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+		s = snapshot()
+	}
+	return s
+}
+
+func TestMetricsRecordTraffic(t *testing.T) {
+	listenerMetrics := NewInMemoryMetrics()
+	connMetrics := NewInMemoryMetrics()
+	cfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(5042)),
+		Callback: func([]byte) error { return nil },
+		Metrics:  listenerMetrics,
+	}
+	bm := NewManager()
+	if err := bm.StartListening(cfg); err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	defer bm.CloseListener(cfg.Address)
+	connCfg := TCPConnConfig{
+		Address: FormatAddress("127.0.0.1", strconv.Itoa(5042)),
+		Metrics: connMetrics,
+	}
+	if err := bm.Dial(&connCfg); err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := bm.Write(connCfg.Address, []byte("hello")); err != nil {
+			t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+		}
+	}
+
+	l := bm.listeningSockets[cfg.Address]
+	s := waitForSnapshot(l.Snapshot, func(s MetricsSnapshot) bool { return s.CallbackLatency.Count == 3 })
+	if s.MessagesIn != 3 || s.BytesIn != 15 || s.CallbackLatency.Count != 3 || s.FrameSizes.Count != 3 {
+		t.Errorf("Expected 3 messages and 15 bytes in, actually got %+v", s)
+	}
+	if s.ActiveConnections != 1 {
+		t.Errorf("Expected 1 active connection, actually got %d", s.ActiveConnections)
+	}
+
+	snapshots := bm.Snapshot()
+	if out := snapshots[connCfg.Address]; out.MessagesOut != 3 || out.BytesOut != 15 || out.ActiveConnections != 1 {
+		t.Errorf("Expected 3 messages and 15 bytes out over 1 connection, actually got %+v", out)
+	}
+	if in := snapshots[cfg.Address]; in.MessagesIn != 3 {
+		t.Errorf("Expected the Manager snapshot to include the listener, actually got %+v", in)
+	}
+
+	bm.CloseWriter(connCfg.Address)
+	s = waitForSnapshot(l.Snapshot, func(s MetricsSnapshot) bool { return s.ActiveConnections == 0 })
+	if s.ActiveConnections != 0 || s.ReadErrors["eof"] != 1 {
+		t.Errorf("Expected the disconnect to be recorded, actually got %+v", s)
+	}
+	if out := connMetrics.Snapshot(connCfg.Address); out.ActiveConnections != 0 {
+		t.Errorf("Expected the closed writer to have no active connections, actually got %d", out.ActiveConnections)
+	}
+}
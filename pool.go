@@ -0,0 +1,239 @@
+package buffstreams
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoHealthyConnections is returned when writing to a pool whose connections
+// are all broken, and waiting to be replaced.
+var ErrNoHealthyConnections = errors.New("No healthy connections are available in the pool.")
+
+// PoolStrategy decides which connection in a pool each write uses.
+type PoolStrategy int
+
+const (
+	// RoundRobin cycles through the healthy connections in turn
+	RoundRobin PoolStrategy = iota
+	// LeastLoaded picks the healthy connection with the fewest writes in progress
+	LeastLoaded
+)
+
+// DefaultPoolReplaceInterval is the value that is used if a PoolConfig indicates
+// a ReplaceInterval of 0
+const DefaultPoolReplaceInterval = time.Second
+
+// PoolConfig represents the information needed to maintain several connections
+// to the same address.
+type PoolConfig struct {
+	// Size is the number of connections to keep open. It must be atleast 1
+	Size int
+	// Strategy decides which connection each write uses
+	Strategy PoolStrategy
+	// ReplaceInterval controls how often broken connections are redialed, if
+	// the first attempt to replace them fails
+	ReplaceInterval time.Duration
+}
+
+// PoolHealth describes the state of a pool at a point in time.
+type PoolHealth struct {
+	Address string
+	// Size is the number of connections the pool maintains
+	Size int
+	// Healthy is the number of those connections currently usable
+	Healthy int
+	// Replacements counts the broken connections that have been redialed
+	Replacements uint64
+}
+
+// ConnPool maintains a fixed number of TCPConns to a single address, spreading
+// writes across them, and replacing broken members in the background. It is
+// safe for concurrent use.
+type ConnPool struct {
+	cfg      TCPConnConfig
+	strategy PoolStrategy
+	members  []*poolMember
+	next     atomic.Uint64
+
+	replacements    atomic.Uint64
+	replaceInterval time.Duration
+	replaceSignal   chan struct{}
+	closeChannel    chan struct{}
+	closeOnce       *sync.Once
+	closeGroup      *sync.WaitGroup
+}
+
+type poolMember struct {
+	conn        atomic.Pointer[TCPConn]
+	healthy     atomic.Bool
+	outstanding atomic.Int64
+}
+
+// DialPool creates a ConnPool, and dials every member. It fails only if none
+// of the members can be dialed. Those that fail start out broken, and are
+// replaced in the background.
+func DialPool(cfg *TCPConnConfig, pcfg PoolConfig) (*ConnPool, error) {
+	size := pcfg.Size
+	if size < 1 {
+		size = 1
+	}
+	replaceInterval := pcfg.ReplaceInterval
+	if replaceInterval == 0 {
+		replaceInterval = DefaultPoolReplaceInterval
+	}
+	p := &ConnPool{
+		cfg:             *cfg,
+		strategy:        pcfg.Strategy,
+		members:         make([]*poolMember, size),
+		replaceInterval: replaceInterval,
+		replaceSignal:   make(chan struct{}, 1),
+		closeChannel:    make(chan struct{}),
+		closeOnce:       &sync.Once{},
+		closeGroup:      &sync.WaitGroup{},
+	}
+	var firstErr error
+	healthy := 0
+	for i := range p.members {
+		m := &poolMember{}
+		p.members[i] = m
+		conn, err := DialTCP(&p.cfg)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		m.conn.Store(conn)
+		m.healthy.Store(true)
+		healthy++
+	}
+	if healthy == 0 {
+		return nil, firstErr
+	}
+	p.closeGroup.Add(1)
+	go p.replaceLoop()
+	if healthy < size {
+		p.signalReplace()
+	}
+	return p, nil
+}
+
+// Write sends data as a single message over one of the pools healthy
+// connections, chosen by the pools Strategy. If the write fails, that connection
+// is marked broken and replaced in the background, and the error is returned. A
+// message refused for it's size doesn't break the connection.
+func (p *ConnPool) Write(data []byte) (int, error) {
+	m := p.pick()
+	if m == nil {
+		return 0, ErrNoHealthyConnections
+	}
+	m.outstanding.Add(1)
+	conn := m.conn.Load()
+	n, err := conn.Write(data)
+	m.outstanding.Add(-1)
+	if conn.brokenBy(err) {
+		m.healthy.Store(false)
+		p.signalReplace()
+	}
+	return n, err
+}
+
+// pick chooses a healthy member, or returns nil if there are none
+func (p *ConnPool) pick() *poolMember {
+	// Start from the next member in turn, so LeastLoaded also spreads ties
+	start := int(p.next.Add(1) % uint64(len(p.members)))
+	var best *poolMember
+	for i := range p.members {
+		m := p.members[(start+i)%len(p.members)]
+		if !m.healthy.Load() {
+			continue
+		}
+		if p.strategy == RoundRobin {
+			return m
+		}
+		if best == nil || m.outstanding.Load() < best.outstanding.Load() {
+			best = m
+		}
+	}
+	return best
+}
+
+func (p *ConnPool) signalReplace() {
+	select {
+	case p.replaceSignal <- struct{}{}:
+	default:
+		// A replacement pass is already pending
+	}
+}
+
+// replaceLoop redials broken members whenever a write fails, and retries
+// every replaceInterval until they are all healthy again
+func (p *ConnPool) replaceLoop() {
+	defer p.closeGroup.Done()
+	ticker := time.NewTicker(p.replaceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.closeChannel:
+			return
+		case <-p.replaceSignal:
+		case <-ticker.C:
+		}
+		for _, m := range p.members {
+			if m.healthy.Load() {
+				continue
+			}
+			conn, err := DialTCP(&p.cfg)
+			if err != nil {
+				continue
+			}
+			// We may have raced a Close, in which case the new conn isn't wanted
+			select {
+			case <-p.closeChannel:
+				conn.Close()
+				return
+			default:
+			}
+			if old := m.conn.Swap(conn); old != nil {
+				old.Close()
+			}
+			m.healthy.Store(true)
+			p.replacements.Add(1)
+		}
+	}
+}
+
+// Health reports how many of the pools connections are currently usable.
+func (p *ConnPool) Health() PoolHealth {
+	h := PoolHealth{
+		Address:      p.cfg.Address,
+		Size:         len(p.members),
+		Replacements: p.replacements.Load(),
+	}
+	for _, m := range p.members {
+		if m.healthy.Load() {
+			h.Healthy++
+		}
+	}
+	return h
+}
+
+// Close stops replacing broken members, and closes every connection in the pool.
+func (p *ConnPool) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closeChannel)
+	})
+	p.closeGroup.Wait()
+	var firstErr error
+	for _, m := range p.members {
+		m.healthy.Store(false)
+		if conn := m.conn.Load(); conn != nil {
+			if err := conn.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,126 @@
+package buffstreams
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManagerPoolSpreadsWritesAndReplacesBrokenMembers(t *testing.T) {
+	var received atomic.Int32
+	cfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(5048)),
+		Callback: func([]byte) error { received.Add(1); return nil },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+
+	bm := NewManager()
+	connCfg := &TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5048))}
+	pcfg := PoolConfig{Size: 3, ReplaceInterval: 10 * time.Millisecond}
+	if err := bm.DialPool(connCfg, pcfg); err != nil {
+		t.Fatalf("Failed to open pool to %s: %s", connCfg.Address, err)
+	}
+	defer bm.CloseWriter(connCfg.Address)
+	if err := bm.Dial(connCfg); err != ErrAlreadyOpened {
+		t.Errorf("Expected ErrAlreadyOpened, actually got %v", err)
+	}
+
+	waitForConnections(t, l, 3)
+	for i := 0; i < 6; i++ {
+		if _, err := bm.Write(connCfg.Address, []byte("pooled")); err != nil {
+			t.Fatalf("Expected pooled write to succeed, actually got %s", err)
+		}
+	}
+	if h, _ := bm.PoolHealth(connCfg.Address); h.Size != 3 || h.Healthy != 3 {
+		t.Errorf("Expected 3 of 3 healthy connections, actually got %+v", h)
+	}
+
+	// Break every member from the server side, then keep writing until the
+	// failures are noticed and the members are replaced
+	for _, info := range l.Connections() {
+		l.Kick(info.ID)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		bm.Write(connCfg.Address, []byte("pooled"))
+		if h, _ := bm.PoolHealth(connCfg.Address); h.Replacements >= 3 && h.Healthy == 3 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	h, err := bm.PoolHealth(connCfg.Address)
+	if err != nil || h.Replacements < 3 || h.Healthy != 3 {
+		t.Fatalf("Expected every member to be replaced, actually got %+v: %v", h, err)
+	}
+	waitForConnections(t, l, 3)
+	if _, err := bm.PoolHealth("127.0.0.1:1"); err != ErrNotOpened {
+		t.Errorf("Expected ErrNotOpened, actually got %v", err)
+	}
+}
+
+func TestPoolPickStrategies(t *testing.T) {
+	members := make([]*poolMember, 3)
+	for i := range members {
+		members[i] = &poolMember{}
+		members[i].healthy.Store(true)
+	}
+	p := &ConnPool{members: members, strategy: RoundRobin}
+	seen := make(map[*poolMember]int)
+	for i := 0; i < 6; i++ {
+		seen[p.pick()]++
+	}
+	for _, m := range members {
+		if seen[m] != 2 {
+			t.Errorf("Expected round robin to pick each member twice, actually got %d", seen[m])
+		}
+	}
+
+	p.strategy = LeastLoaded
+	members[0].outstanding.Store(2)
+	members[2].outstanding.Store(1)
+	for i := 0; i < 3; i++ {
+		if m := p.pick(); m != members[1] {
+			t.Errorf("Expected least loaded member to be picked")
+		}
+	}
+
+	members[1].healthy.Store(false)
+	if m := p.pick(); m != members[2] {
+		t.Errorf("Expected broken member to be skipped")
+	}
+	for _, m := range members {
+		m.healthy.Store(false)
+	}
+	if m := p.pick(); m != nil {
+		t.Errorf("Expected no member when all are broken")
+	}
+}
+
+func TestPoolKeepsMembersThatRefuseAMessage(t *testing.T) {
+	var received atomic.Int32
+	l := startCountingListener(t, 5083, &received)
+	defer l.Close()
+
+	bm := NewManager()
+	connCfg := &TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5083))}
+	if err := bm.DialPool(connCfg, PoolConfig{Size: 1, ReplaceInterval: time.Hour}); err != nil {
+		t.Fatalf("Failed to open pool to %s: %s", connCfg.Address, err)
+	}
+	defer bm.CloseWriter(connCfg.Address)
+	if _, err := bm.Write(connCfg.Address, nil); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected an empty message to be refused, actually got %v", err)
+	}
+	if _, err := bm.Write(connCfg.Address, []byte("pooled")); err != nil {
+		t.Errorf("Expected the member to still be healthy, actually got %s", err)
+	}
+	if h, _ := bm.PoolHealth(connCfg.Address); h.Healthy != 1 || h.Replacements != 0 {
+		t.Errorf("Expected the member to be kept, actually got %+v", h)
+	}
+}
@@ -0,0 +1,162 @@
+// Package prometheus exposes the measurements recorded by buffstreams Metrics
+// in the Prometheus text exposition format, without depending on the
+// Prometheus client libraries.
+package prometheus
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/StabbyCutyou/buffstreams"
+)
+
+// ContentType is the media type of the Prometheus text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Source provides the snapshots to render, keyed by address. It is satisfied
+// by *buffstreams.InMemoryMetrics.
+type Source interface {
+	Snapshots() map[string]buffstreams.MetricsSnapshot
+}
+
+// Handler returns an http.Handler that renders every snapshot from source on
+// each request. Every series is labeled with the address it was recorded for.
+func Handler(source Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		bw := bufio.NewWriter(w)
+		Write(bw, source.Snapshots())
+		bw.Flush()
+	})
+}
+
+// counter describes a single valued series taken from each snapshot
+type counter struct {
+	name, help, kind string
+	value            func(buffstreams.MetricsSnapshot) float64
+}
+
+var counters = []counter{
+	{"buffstreams_messages_in_total", "Messages read.", "counter",
+		func(s buffstreams.MetricsSnapshot) float64 { return float64(s.MessagesIn) }},
+	{"buffstreams_messages_out_total", "Messages written.", "counter",
+		func(s buffstreams.MetricsSnapshot) float64 { return float64(s.MessagesOut) }},
+	{"buffstreams_bytes_in_total", "Payload bytes read.", "counter",
+		func(s buffstreams.MetricsSnapshot) float64 { return float64(s.BytesIn) }},
+	{"buffstreams_bytes_out_total", "Payload bytes written.", "counter",
+		func(s buffstreams.MetricsSnapshot) float64 { return float64(s.BytesOut) }},
+	{"buffstreams_active_connections", "Connections currently open.", "gauge",
+		func(s buffstreams.MetricsSnapshot) float64 { return float64(s.ActiveConnections) }},
+	{"buffstreams_reconnects_total", "Successful reconnects.", "counter",
+		func(s buffstreams.MetricsSnapshot) float64 { return float64(s.Reconnects) }},
+}
+
+// errorCounter describes a series taken from each snapshot, per error kind
+type errorCounter struct {
+	name, help string
+	value      func(buffstreams.MetricsSnapshot) map[string]uint64
+}
+
+var errorCounters = []errorCounter{
+	{"buffstreams_read_errors_total", "Failed reads, by kind of error.",
+		func(s buffstreams.MetricsSnapshot) map[string]uint64 { return s.ReadErrors }},
+	{"buffstreams_write_errors_total", "Failed writes, by kind of error.",
+		func(s buffstreams.MetricsSnapshot) map[string]uint64 { return s.WriteErrors }},
+	{"buffstreams_throttled_total", "Messages over a rate limit, by the action taken.",
+		func(s buffstreams.MetricsSnapshot) map[string]uint64 { return s.Throttled }},
+	{"buffstreams_rejected_connections_total", "Connections refused by admission control, by reason.",
+		func(s buffstreams.MetricsSnapshot) map[string]uint64 { return s.Rejected }},
+}
+
+// histogram describes a histogram taken from each snapshot
+type histogram struct {
+	name, help string
+	value      func(buffstreams.MetricsSnapshot) buffstreams.Histogram
+}
+
+var histograms = []histogram{
+	{"buffstreams_frame_size_bytes", "Payload size of messages read and written.",
+		func(s buffstreams.MetricsSnapshot) buffstreams.Histogram { return s.FrameSizes }},
+	{"buffstreams_callback_latency_seconds", "Time spent in the listener Callback.",
+		func(s buffstreams.MetricsSnapshot) buffstreams.Histogram { return s.CallbackLatency }},
+}
+
+// Write renders snapshots in the Prometheus text exposition format. Addresses
+// and error kinds are sorted, so the output is stable between calls.
+func Write(w *bufio.Writer, snapshots map[string]buffstreams.MetricsSnapshot) {
+	addresses := make([]string, 0, len(snapshots))
+	for address := range snapshots {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+
+	for _, c := range counters {
+		writeHeader(w, c.name, c.help, c.kind)
+		for _, address := range addresses {
+			writeSample(w, c.name, labels("address", address), c.value(snapshots[address]))
+		}
+	}
+
+	for _, c := range errorCounters {
+		writeHeader(w, c.name, c.help, "counter")
+		for _, address := range addresses {
+			byKind := c.value(snapshots[address])
+			kinds := make([]string, 0, len(byKind))
+			for kind := range byKind {
+				kinds = append(kinds, kind)
+			}
+			sort.Strings(kinds)
+			for _, kind := range kinds {
+				writeSample(w, c.name, labels("address", address, "kind", kind), float64(byKind[kind]))
+			}
+		}
+	}
+
+	for _, h := range histograms {
+		writeHeader(w, h.name, h.help, "histogram")
+		for _, address := range addresses {
+			hist := h.value(snapshots[address])
+			// Prometheus buckets are cumulative, ours are not
+			var cumulative uint64
+			for i, bound := range hist.Bounds {
+				cumulative += hist.Counts[i]
+				writeSample(w, h.name+"_bucket", labels("address", address, "le", formatFloat(bound)), float64(cumulative))
+			}
+			writeSample(w, h.name+"_bucket", labels("address", address, "le", "+Inf"), float64(hist.Count))
+			writeSample(w, h.name+"_sum", labels("address", address), hist.Sum)
+			writeSample(w, h.name+"_count", labels("address", address), float64(hist.Count))
+		}
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	w.WriteString(name + labels + " " + formatFloat(value) + "\n")
+}
+
+// labels renders name, value pairs as a label set
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i] + `="` + labelEscaper.Replace(pairs[i+1]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,63 @@
+package prometheus
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/StabbyCutyou/buffstreams"
+)
+
+func TestHandlerRendersSnapshots(t *testing.T) {
+	m := buffstreams.NewInMemoryMetrics()
+	m.ConnectionOpened(":5031")
+	m.MessageRead(":5031", 100)
+	m.MessageRead(":5031", 5000)
+	m.ReadError(":5031", "eof")
+	m.WriteError(`we"ird`, "closed")
+
+	srv := httptest.NewServer(Handler(m))
+	defer srv.Close()
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Failed to scrape handler: %s", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+		t.Errorf("Expected Content-Type %s, actually got %s", ContentType, ct)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Failed to read scrape: %s", err)
+	}
+	body := string(b)
+
+	expected := []string{
+		"# TYPE buffstreams_messages_in_total counter\n",
+		`buffstreams_messages_in_total{address=":5031"} 2` + "\n",
+		`buffstreams_bytes_in_total{address=":5031"} 5100` + "\n",
+		"# TYPE buffstreams_active_connections gauge\n",
+		`buffstreams_active_connections{address=":5031"} 1` + "\n",
+		`buffstreams_read_errors_total{address=":5031",kind="eof"} 1` + "\n",
+		`buffstreams_write_errors_total{address="we\"ird",kind="closed"} 1` + "\n",
+		"# TYPE buffstreams_frame_size_bytes histogram\n",
+		`buffstreams_frame_size_bytes_bucket{address=":5031",le="64"} 0` + "\n",
+		`buffstreams_frame_size_bytes_bucket{address=":5031",le="256"} 1` + "\n",
+		`buffstreams_frame_size_bytes_bucket{address=":5031",le="4096"} 1` + "\n",
+		`buffstreams_frame_size_bytes_bucket{address=":5031",le="16384"} 2` + "\n",
+		`buffstreams_frame_size_bytes_bucket{address=":5031",le="+Inf"} 2` + "\n",
+		`buffstreams_frame_size_bytes_sum{address=":5031"} 5100` + "\n",
+		`buffstreams_frame_size_bytes_count{address=":5031"} 2` + "\n",
+		`buffstreams_callback_latency_seconds_count{address=":5031"} 0` + "\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected scrape to contain %q, actually got:\n%s", line, body)
+		}
+	}
+	// Addresses are sorted, so the output is stable
+	if strings.Index(body, `{address=":5031"}`) > strings.Index(body, `{address="we\"ird"}`) {
+		t.Errorf("Expected addresses to be sorted, actually got:\n%s", body)
+	}
+}
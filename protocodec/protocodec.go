@@ -0,0 +1,37 @@
+// Package protocodec provides a buffstreams.Codec for protocol buffer messages.
+// It lives apart from buffstreams itself, so the core library doesn't depend on
+// the protobuf runtime.
+package protocodec
+
+import (
+	"errors"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// ErrNotProtoMessage is returned when a value that is not a proto.Message is
+// passed to the Codec.
+var ErrNotProtoMessage = errors.New("Value does not implement proto.Message.")
+
+// Codec is a buffstreams.Codec for values implementing proto.Message. When used
+// with a Sender or TypedCallback, the type parameter should be the generated
+// pointer type, ie: buffstreams.TypedCallback[*message.Note](protocodec.Codec{}, handle)
+type Codec struct{}
+
+// Marshal implements buffstreams.Codec
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(msg)
+}
+
+// Unmarshal implements buffstreams.Codec
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	msg, ok := v.(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, msg)
+}
@@ -0,0 +1,56 @@
+package protocodec
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/StabbyCutyou/buffstreams"
+	"github.com/StabbyCutyou/buffstreams/test/message"
+)
+
+func TestCodecRoundTripsNotes(t *testing.T) {
+	received := make(chan *message.Note, 1)
+	cfg := buffstreams.TCPListenerConfig{
+		Address: buffstreams.FormatAddress("", strconv.Itoa(5045)),
+		Callback: buffstreams.TypedCallback[*message.Note](Codec{}, func(n *message.Note) error {
+			received <- n
+			return nil
+		}),
+	}
+	l, err := buffstreams.ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	connCfg := buffstreams.TCPConnConfig{Address: buffstreams.FormatAddress("127.0.0.1", strconv.Itoa(5045))}
+	c, err := buffstreams.DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+
+	name, date, comment := "Stabby", time.Now().UnixNano(), "hello"
+	if _, err := buffstreams.NewSender[*message.Note](c, Codec{}).Send(&message.Note{Name: &name, Date: &date, Comment: &comment}); err != nil {
+		t.Fatalf("Failed to send to %s: %s", connCfg.Address, err)
+	}
+	select {
+	case n := <-received:
+		if n.GetName() != name || n.GetDate() != date || n.GetComment() != comment {
+			t.Errorf("Expected the note to round trip, actually got %v", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected to receive the note")
+	}
+}
+
+func TestCodecRejectsNonMessages(t *testing.T) {
+	if _, err := (Codec{}).Marshal("not a message"); err != ErrNotProtoMessage {
+		t.Errorf("Expected ErrNotProtoMessage, actually got %v", err)
+	}
+	var s string
+	if err := (Codec{}).Unmarshal(nil, &s); err != ErrNotProtoMessage {
+		t.Errorf("Expected ErrNotProtoMessage, actually got %v", err)
+	}
+}
@@ -0,0 +1,194 @@
+package buffstreams
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidProxyHeader is the reason given to OnReject for connections from
+	// a trusted proxy that didn't begin with a valid PROXY protocol header.
+	ErrInvalidProxyHeader = errors.New("The connection did not begin with a valid PROXY protocol header.")
+	// ErrProxyHeaderTimeout is the reason given to OnReject for connections from a
+	// trusted proxy that didn't send their PROXY protocol header in time.
+	ErrProxyHeaderTimeout = errors.New("The PROXY protocol header did not arrive in time.")
+)
+
+// DefaultProxyHeaderTimeout is how long a trusted proxy has to send the PROXY
+// protocol header, if no ProxyHeaderTimeout is configured.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// The PROXY protocol, as sent by HAProxy and most TCP load balancers, begins a
+// connection with a header describing the client it is relaying. Version 1 is a
+// single line of text:
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 5031\r\n
+//
+// Version 2 is binary, beginning with proxyV2Signature:
+//
+//	| signature (12 bytes) | version and command | family | length (2 bytes, big endian) | addresses | TLVs |
+//
+// Either may also say the connection wasn't relayed for a client, such as a
+// health check from the proxy itself, in which case the proxy's own address is kept.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	// proxyV1Prefix begins every version 1 header
+	proxyV1Prefix = "PROXY "
+	// proxyV1MaxLength is the longest a version 1 header may be, including the CRLF
+	proxyV1MaxLength = 107
+	// proxyV2HeaderSize is the length of the fixed part of a version 2 header
+	proxyV2HeaderSize = 16
+)
+
+// Version 2 commands and the address families carried over TCP
+const (
+	proxyV2Local byte = 0x20
+	proxyV2Proxy byte = 0x21
+	proxyV2TCP4  byte = 0x11
+	proxyV2TCP6  byte = 0x21
+)
+
+// trustedProxy reports whether the connection came from one of the prefixes
+// trusted to send a PROXY protocol header
+func trustedProxy(conn *TCPConn, trusted []netip.Prefix) bool {
+	addr := conn.remoteAddr()
+	for _, prefix := range trusted {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptProxied reads the PROXY protocol header of a connection from a trusted
+// proxy, on it's own goroutine so a slow proxy can't hold up accepting, and then
+// carries on accepting it as the client the header describes
+func (t *TCPListener) acceptProxied(conn *TCPConn, timeout time.Duration) {
+	if timeout == 0 {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	conn.setReadDeadline(conn.socket, time.Now().Add(timeout))
+	stop := t.interruptOnShutdown(conn)
+	client, err := readProxyHeader(conn.socket)
+	stop()
+	conn.setReadDeadline(conn.socket, time.Time{})
+	select {
+	case <-t.shutdownChannel:
+		conn.Close()
+		return
+	default:
+	}
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			err = ErrProxyHeaderTimeout
+		} else {
+			err = ErrInvalidProxyHeader
+		}
+		t.reject(conn, err)
+		return
+	}
+	if client.IsValid() {
+		conn.proxyAddress = conn.socket.RemoteAddr().String()
+		conn.clientAddress = client
+	}
+	t.accept(conn)
+}
+
+// readProxyHeader reads a version 1 or 2 PROXY protocol header, without reading
+// any further, returning the address of the client it describes. The address
+// is the zero value if the connection wasn't relayed for a client.
+func readProxyHeader(r io.Reader) (netip.AddrPort, error) {
+	// A version 1 header is never shorter than the version 2 signature
+	header := make([]byte, len(proxyV2Signature), proxyV1MaxLength)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if bytes.Equal(header, proxyV2Signature) {
+		return readProxyV2(r)
+	}
+	// Nor can it end within it
+	if !bytes.HasPrefix(header, []byte(proxyV1Prefix)) || bytes.Contains(header, []byte("\r\n")) {
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+	// The line has to be read a byte at a time, so none of the first frame is
+	// consumed along with it
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n")) {
+		if len(header) == proxyV1MaxLength {
+			return netip.AddrPort{}, ErrInvalidProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return netip.AddrPort{}, err
+		}
+		header = append(header, b[0])
+	}
+	return parseProxyV1(string(header[len(proxyV1Prefix) : len(header)-2]))
+}
+
+// parseProxyV1 parses the fields of a version 1 header, after the prefix
+func parseProxyV1(line string) (netip.AddrPort, error) {
+	fields := strings.Split(line, " ")
+	if fields[0] == "UNKNOWN" {
+		return netip.AddrPort{}, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+	addr, err := netip.ParseAddr(fields[1])
+	if err != nil || addr.Is4() != (fields[0] == "TCP4") {
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+	return netip.AddrPortFrom(addr, uint16(port)), nil
+}
+
+// readProxyV2 reads the rest of a version 2 header, after the signature
+func readProxyV2(r io.Reader) (netip.AddrPort, error) {
+	header := make([]byte, proxyV2HeaderSize-len(proxyV2Signature))
+	if _, err := io.ReadFull(r, header); err != nil {
+		return netip.AddrPort{}, err
+	}
+	command, family := header[0], header[1]
+	// The addresses and TLVs are read whole, so the stream is left at the first frame
+	body := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return netip.AddrPort{}, err
+	}
+	switch command {
+	case proxyV2Local:
+		return netip.AddrPort{}, nil
+	case proxyV2Proxy:
+	default:
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+	// The source address comes first, then the destination, then their ports
+	var size int
+	switch family {
+	case proxyV2TCP4:
+		size = 4
+	case proxyV2TCP6:
+		size = 16
+	default:
+		// UDP and unix sockets can't be relayed to a TCP listener, so there is no
+		// client address to use
+		return netip.AddrPort{}, nil
+	}
+	if len(body) < 2*size+4 {
+		return netip.AddrPort{}, ErrInvalidProxyHeader
+	}
+	addr, _ := netip.AddrFromSlice(body[:size])
+	port := binary.BigEndian.Uint16(body[2*size:])
+	return netip.AddrPortFrom(addr, port), nil
+}
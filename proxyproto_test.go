@@ -0,0 +1,176 @@
+package buffstreams
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a version 2 header relaying client, with a TLV after
+// the addresses
+func proxyV2Header(command byte, client netip.AddrPort) []byte {
+	var addresses []byte
+	family := proxyV2TCP4
+	if client.Addr().Is6() {
+		family = proxyV2TCP6
+	}
+	addresses = append(addresses, client.Addr().AsSlice()...)
+	addresses = append(addresses, client.Addr().AsSlice()...)
+	addresses = binary.BigEndian.AppendUint16(addresses, client.Port())
+	addresses = binary.BigEndian.AppendUint16(addresses, 5031)
+	addresses = append(addresses, 0x04, 0, 1, 'x')
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	client4 := netip.MustParseAddrPort("192.0.2.1:56324")
+	client6 := netip.MustParseAddrPort("[2001:db8::1]:56324")
+	cases := []struct {
+		header string
+		want   netip.AddrPort
+		err    error
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 56324 5031\r\n", client4, nil},
+		{"PROXY TCP6 2001:db8::1 2001:db8::2 56324 5031\r\n", client6, nil},
+		{"PROXY UNKNOWN\r\n", netip.AddrPort{}, nil},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", netip.AddrPort{}, nil},
+		{string(proxyV2Header(proxyV2Proxy, client4)), client4, nil},
+		{string(proxyV2Header(proxyV2Proxy, client6)), client6, nil},
+		{string(proxyV2Header(proxyV2Local, client4)), netip.AddrPort{}, nil},
+		{"PROXY TCP4 2001:db8::1 198.51.100.1 56324 5031\r\n", netip.AddrPort{}, ErrInvalidProxyHeader},
+		{"PROXY TCP4 192.0.2.1 198.51.100.1 99999 5031\r\n", netip.AddrPort{}, ErrInvalidProxyHeader},
+		{"PROXY UDP4 192.0.2.1 198.51.100.1 56324 5031\r\n", netip.AddrPort{}, ErrInvalidProxyHeader},
+		{"PROXY TCP4 " + string(bytes.Repeat([]byte{'1'}, 100)) + "\r\n", netip.AddrPort{}, ErrInvalidProxyHeader},
+		{"GET / HTTP/1.1\r\n", netip.AddrPort{}, ErrInvalidProxyHeader},
+		{"PROXY ME\r\n", netip.AddrPort{}, ErrInvalidProxyHeader},
+		{string(proxyV2Header(0x22, client4)), netip.AddrPort{}, ErrInvalidProxyHeader},
+		{string(proxyV2Signature) + "\x21\x11\x00\x04abcd", netip.AddrPort{}, ErrInvalidProxyHeader},
+	}
+	for _, c := range cases {
+		// Nothing after the header may be consumed
+		r := bytes.NewReader([]byte(c.header + "frame"))
+		client, err := readProxyHeader(r)
+		if err != c.err || client != c.want {
+			t.Errorf("For %q, expected %v, %v, actually got %v, %v", c.header, c.want, c.err, client, err)
+		}
+		if c.err == nil && r.Len() != len("frame") {
+			t.Errorf("For %q, expected the frame to be left unread, actually %d bytes remain", c.header, r.Len())
+		}
+	}
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	metrics := NewInMemoryMetrics()
+	connected := make(chan ConnectionInfo, 10)
+	received := make(chan string, 10)
+	senders := make(chan ConnectionInfo, 10)
+	l, rejected := startAdmissionListener(t, 5080, TCPListenerConfig{
+		Metrics:        metrics,
+		TrustedProxies: []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")},
+		DenyCIDRs:      []netip.Prefix{netip.MustParsePrefix("203.0.113.0/24")},
+		OnConnect:      func(info ConnectionInfo) { connected <- info },
+		ContextCallback: func(ctx context.Context, data []byte) error {
+			info, _ := ConnectionInfoFromContext(ctx)
+			senders <- info
+			received <- string(data)
+			return nil
+		},
+	})
+	defer l.Close()
+
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5080))
+	headerSize := messageSizeToBitLength(DefaultMaxMessageSize)
+	relay := func(header string) net.Conn {
+		raw, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("Failed to open connection: %s", err)
+		}
+		raw.Write(append(append([]byte(header), intToByteArray(5, headerSize)...), "hello"...))
+		return raw
+	}
+
+	raw := relay("PROXY TCP4 192.0.2.1 127.0.0.1 56324 5080\r\n")
+	defer raw.Close()
+	select {
+	case info := <-connected:
+		if info.RemoteAddress != "192.0.2.1:56324" || info.ProxyAddress != raw.LocalAddr().String() {
+			t.Errorf("Expected the client's address, relayed by the proxy, actually got %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the relayed client to connect")
+	}
+	select {
+	case data := <-received:
+		if data != "hello" {
+			t.Errorf("Expected the message after the header, actually got %q", data)
+		}
+		if info := <-senders; info.RemoteAddress != "192.0.2.1:56324" {
+			t.Errorf("Expected the Callback to see the client's address, actually got %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the message to reach the Callback")
+	}
+
+	// Admission control applies to the client, not the proxy
+	denied := relay(string(proxyV2Header(proxyV2Proxy, netip.MustParseAddrPort("203.0.113.9:4000"))))
+	defer denied.Close()
+	if err := <-rejected; err != ErrAddressDenied {
+		t.Errorf("Expected ErrAddressDenied, actually got %v", err)
+	}
+
+	invalid := relay("PROXY ME\r\n")
+	defer invalid.Close()
+	if err := <-rejected; err != ErrInvalidProxyHeader {
+		t.Errorf("Expected ErrInvalidProxyHeader, actually got %v", err)
+	}
+	if s := l.Snapshot(); s.Rejected["proxy_protocol"] != 1 || s.Rejected["denied"] != 1 {
+		t.Errorf("Expected the rejections to be counted, actually got %v", s.Rejected)
+	}
+}
+
+func TestListenerProxyProtocolOnlyFromTrustedProxies(t *testing.T) {
+	l, rejected := startAdmissionListener(t, 5081, TCPListenerConfig{
+		TrustedProxies:     []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+		ProxyHeaderTimeout: 50 * time.Millisecond,
+	})
+	defer l.Close()
+
+	// Anyone else is served as they are, with no header expected
+	conn, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5081))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer conn.Close()
+	waitForConnections(t, l, 1)
+	if info := l.Connections()[0]; info.ProxyAddress != "" || info.RemoteAddress != conn.socket.LocalAddr().String() {
+		t.Errorf("Expected the untrusted client to keep it's own address, actually got %+v", info)
+	}
+
+	l.Reload(TCPListenerConfig{
+		Callback:           func([]byte) error { return nil },
+		OnReject:           func(_ ConnectionInfo, err error) { rejected <- err },
+		TrustedProxies:     []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")},
+		ProxyHeaderTimeout: 50 * time.Millisecond,
+	})
+	raw, err := net.Dial("tcp", FormatAddress("127.0.0.1", strconv.Itoa(5081)))
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer raw.Close()
+	select {
+	case err := <-rejected:
+		if err != ErrProxyHeaderTimeout {
+			t.Errorf("Expected ErrProxyHeaderTimeout, actually got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected a proxy that never sends the header to be rejected")
+	}
+}
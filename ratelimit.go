@@ -0,0 +1,217 @@
+package buffstreams
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is the reason given to OnDisconnect for connections that were
+// closed for exceeding a rate limit, when RateLimitAction is RateLimitDisconnect.
+var ErrRateLimited = errors.New("The connection exceeded it's rate limit.")
+
+// RateLimitAction is what a TCPListener does with a message that exceeds it's
+// rate limits.
+type RateLimitAction int
+
+const (
+	// RateLimitDelay holds the message until the limits allow it, before running
+	// the Callback. Nothing more is read from the client in the meantime, so TCP
+	// backpressure slows it down to the limit.
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitDrop discards the message without running the Callback
+	RateLimitDrop
+	// RateLimitDisconnect closes the connection
+	RateLimitDisconnect
+)
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDelay:
+		return "delay"
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitDisconnect:
+		return "disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+// RateLimit describes a pair of token buckets, limiting the messages and the
+// payload bytes a client may send. A rate of 0 leaves that dimension unlimited.
+type RateLimit struct {
+	// MessagesPerSecond is the sustained rate of messages allowed
+	MessagesPerSecond float64
+	// MessageBurst is how many messages may arrive at once, after a quiet period.
+	// 0 allows one seconds worth.
+	MessageBurst int
+	// BytesPerSecond is the sustained rate of payload bytes allowed
+	BytesPerSecond float64
+	// ByteBurst is how many bytes may arrive at once, after a quiet period. 0
+	// allows one seconds worth. A message larger than the burst is let through
+	// once the bucket is full, rather than never.
+	ByteBurst int
+}
+
+// tokenBucket refills at rate tokens per second, up to burst
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	b := float64(burst)
+	if burst <= 0 {
+		b = math.Max(rate, 1)
+	}
+	return &tokenBucket{rate: rate, burst: b, tokens: b, last: time.Now()}
+}
+
+// refill must be called with the lock held
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// take removes n tokens if they are all available, and reports whether it did
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	n = math.Min(n, b.burst)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// reserve removes n tokens, going into debt if need be, and returns how long
+// the caller must wait for the debt to be repaid
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.refill(now)
+	b.tokens -= math.Min(n, b.burst)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// refund returns n tokens taken by take
+func (b *tokenBucket) refund(n float64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+math.Min(n, b.burst))
+}
+
+// rateLimiter holds the buckets for a single RateLimit. Either may be nil.
+type rateLimiter struct {
+	messages *tokenBucket
+	bytes    *tokenBucket
+}
+
+func newRateLimiter(limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	r := &rateLimiter{}
+	if limit.MessagesPerSecond > 0 {
+		r.messages = newTokenBucket(limit.MessagesPerSecond, limit.MessageBurst)
+	}
+	if limit.BytesPerSecond > 0 {
+		r.bytes = newTokenBucket(limit.BytesPerSecond, limit.ByteBurst)
+	}
+	return r
+}
+
+// buckets returns the bucket for each dimension of each limiter that is in use,
+// paired with the cost of a message of size bytes against it
+func buckets(size int, limiters ...*rateLimiter) ([]*tokenBucket, []float64) {
+	var bs []*tokenBucket
+	var costs []float64
+	for _, r := range limiters {
+		if r == nil {
+			continue
+		}
+		if r.messages != nil {
+			bs, costs = append(bs, r.messages), append(costs, 1)
+		}
+		if r.bytes != nil {
+			bs, costs = append(bs, r.bytes), append(costs, float64(size))
+		}
+	}
+	return bs, costs
+}
+
+// allowMessage takes a message of size bytes from every limiter, if they all
+// have room for it. Otherwise none of them are charged.
+func allowMessage(size int, limiters ...*rateLimiter) bool {
+	bs, costs := buckets(size, limiters...)
+	now := time.Now()
+	for i, b := range bs {
+		if !b.take(costs[i], now) {
+			for j := 0; j < i; j++ {
+				bs[j].refund(costs[j])
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// reserveMessage charges a message of size bytes to every limiter, and returns
+// how long to wait before it is within all of them
+func reserveMessage(size int, limiters ...*rateLimiter) time.Duration {
+	bs, costs := buckets(size, limiters...)
+	now := time.Now()
+	var wait time.Duration
+	for i, b := range bs {
+		if w := b.reserve(costs[i], now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// ipLimiter is the limiter shared by every connection from one remote IP
+type ipLimiter struct {
+	limiter *rateLimiter
+	refs    int
+}
+
+// acquireIPLimiter returns the limiter shared by connections from ip, creating
+// it if this is the first. Each call must be paired with a releaseIPLimiter.
+func (t *TCPListener) acquireIPLimiter(ip string, limit *RateLimit) *rateLimiter {
+	if limit == nil {
+		return nil
+	}
+	t.ipLimitersLock.Lock()
+	defer t.ipLimitersLock.Unlock()
+	l, ok := t.ipLimiters[ip]
+	if !ok {
+		l = &ipLimiter{limiter: newRateLimiter(limit)}
+		t.ipLimiters[ip] = l
+	}
+	l.refs++
+	return l.limiter
+}
+
+// releaseIPLimiter forgets the limiter for ip once it's last connection is gone
+func (t *TCPListener) releaseIPLimiter(ip string) {
+	t.ipLimitersLock.Lock()
+	defer t.ipLimitersLock.Unlock()
+	if l, ok := t.ipLimiters[ip]; ok {
+		if l.refs--; l.refs == 0 {
+			delete(t.ipLimiters, ip)
+		}
+	}
+}
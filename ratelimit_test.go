@@ -0,0 +1,150 @@
+package buffstreams
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(10, 5)
+	now := b.last
+	for i := 0; i < 5; i++ {
+		if !b.take(1, now) {
+			t.Fatalf("Expected the burst of 5 to be allowed, failed on %d", i)
+		}
+	}
+	if b.take(1, now) {
+		t.Errorf("Expected the bucket to be empty after the burst")
+	}
+	// 10 per second refills one token every 100ms
+	if !b.take(1, now.Add(100*time.Millisecond)) {
+		t.Errorf("Expected a token to be refilled after 100ms")
+	}
+	// More than the burst is charged as the whole burst, so it can still pass
+	if !b.take(50, now.Add(time.Second)) {
+		t.Errorf("Expected a cost larger than the burst to be allowed from a full bucket")
+	}
+	if wait := b.reserve(2, now.Add(time.Second)); wait < 150*time.Millisecond || wait > 250*time.Millisecond {
+		t.Errorf("Expected a 200ms wait to repay the debt, actually %s", wait)
+	}
+}
+
+func TestListenerRateLimitDrop(t *testing.T) {
+	metrics := NewInMemoryMetrics()
+	var received atomic.Int32
+	cfg := TCPListenerConfig{
+		Address:         FormatAddress("", strconv.Itoa(5068)),
+		Metrics:         metrics,
+		Callback:        func([]byte) error { received.Add(1); return nil },
+		ConnRateLimit:   &RateLimit{MessagesPerSecond: 1, MessageBurst: 5},
+		RateLimitAction: RateLimitDrop,
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	defer l.Close()
+	l.StartListeningAsync()
+
+	conn, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5068))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer conn.Close()
+	for i := 0; i < 20; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Expected Write to succeed, actually got %s", err)
+		}
+	}
+	s := waitForSnapshot(l.Snapshot, func(s MetricsSnapshot) bool { return s.MessagesIn == 20 })
+	if got := received.Load(); got < 5 || got > 6 {
+		t.Errorf("Expected only the burst of 5 messages to reach the Callback, actually %d", got)
+	}
+	if dropped := s.Throttled["drop"]; dropped+uint64(received.Load()) != 20 {
+		t.Errorf("Expected every message over the limit to be counted as dropped, actually %d", dropped)
+	}
+}
+
+func TestListenerRateLimitPerIPDisconnects(t *testing.T) {
+	var received atomic.Int32
+	disconnected := make(chan error, 2)
+	cfg := TCPListenerConfig{
+		Address:         FormatAddress("", strconv.Itoa(5069)),
+		Callback:        func([]byte) error { received.Add(1); return nil },
+		IPRateLimit:     &RateLimit{BytesPerSecond: 1, ByteBurst: 30},
+		RateLimitAction: RateLimitDisconnect,
+		OnDisconnect:    func(_ ConnectionInfo, err error) { disconnected <- err },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	defer l.Close()
+	l.StartListeningAsync()
+
+	// Both connections come from 127.0.0.1, so they share the 30 bytes
+	address := FormatAddress("127.0.0.1", strconv.Itoa(5069))
+	first, err := DialTCP(&TCPConnConfig{Address: address})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer first.Close()
+	second, err := DialTCP(&TCPConnConfig{Address: address})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer second.Close()
+	waitForConnections(t, l, 2)
+
+	message := make([]byte, 10)
+	for _, c := range []*TCPConn{first, second, first} {
+		if _, err := c.Write(message); err != nil {
+			t.Fatalf("Expected Write to succeed, actually got %s", err)
+		}
+	}
+	waitForCount(t, &received, 3)
+	if _, err := second.Write(message); err != nil {
+		t.Fatalf("Expected Write to succeed, actually got %s", err)
+	}
+	select {
+	case err := <-disconnected:
+		if err != ErrRateLimited {
+			t.Errorf("Expected the connection to be closed with ErrRateLimited, actually got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection over the limit to be closed")
+	}
+	if got := received.Load(); got != 3 {
+		t.Errorf("Expected the message over the limit not to reach the Callback, actually %d did", got)
+	}
+}
+
+func TestListenerRateLimitDelay(t *testing.T) {
+	var received atomic.Int32
+	l := startCountingListener(t, 5070, &received)
+	defer l.Close()
+	cfg := l.Config()
+	cfg.ConnRateLimit = &RateLimit{MessagesPerSecond: 50, MessageBurst: 1}
+	if err := l.Reload(cfg); err != nil {
+		t.Fatalf("Failed to reload: %s", err)
+	}
+
+	conn, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5070))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			t.Fatalf("Expected Write to succeed, actually got %s", err)
+		}
+	}
+	waitForCount(t, &received, 6)
+	// The first is free, and each of the other 5 waits 20ms
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Errorf("Expected the messages to be delayed to the limit, but they all arrived in %s", elapsed)
+	}
+}
@@ -0,0 +1,66 @@
+package buffstreams
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrNoAddresses is reported when a Resolver returns an empty set of addresses.
+// The destination keeps it's current backends rather than drop them all.
+var ErrNoAddresses = errors.New("Resolver returned no addresses.")
+
+// DefaultResolveInterval is the value that is used if a DestinationConfig with a
+// Resolver indicates a ResolveInterval of 0
+const DefaultResolveInterval = 10 * time.Second
+
+// Resolver provides the current set of backend addresses for a destination.
+// A Manager calls it every ResolveInterval, and reconciles the destinations
+// connections with the result.
+type Resolver interface {
+	Resolve(ctx context.Context) ([]string, error)
+}
+
+// StaticResolver is a Resolver that always returns the same addresses.
+type StaticResolver []string
+
+// Resolve implements Resolver
+func (r StaticResolver) Resolve(ctx context.Context) ([]string, error) {
+	return r, nil
+}
+
+// SRVResolver is a Resolver that looks up DNS SRV records, as described by
+// net.LookupSRV. Only the records with the most preferred (lowest) priority are
+// used, so lower priority targets are held back until those are removed.
+type SRVResolver struct {
+	Service string
+	Proto   string
+	Name    string
+	// Resolver is used to do the lookup, or net.DefaultResolver if it is nil
+	Resolver *net.Resolver
+}
+
+// Resolve implements Resolver
+func (r *SRVResolver) Resolve(ctx context.Context) ([]string, error) {
+	resolver := r.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	_, records, err := resolver.LookupSRV(ctx, r.Service, r.Proto, r.Name)
+	if err != nil {
+		return nil, err
+	}
+	var addresses []string
+	for _, record := range records {
+		// Records come back sorted by priority
+		if record.Priority != records[0].Priority {
+			break
+		}
+		host := strings.TrimSuffix(record.Target, ".")
+		addresses = append(addresses, net.JoinHostPort(host, strconv.Itoa(int(record.Port))))
+	}
+	return addresses, nil
+}
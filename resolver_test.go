@@ -0,0 +1,187 @@
+package buffstreams
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// srvRecord is an answer served by startStubDNS
+type srvRecord struct {
+	priority, weight, port uint16
+	target                 string
+}
+
+// startStubDNS serves every query it receives over UDP with the same SRV
+// records, and returns the address it listens on
+func startStubDNS(t *testing.T, records []srvRecord) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not start stub DNS server: %s", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			query := buf[:n]
+			// The question follows the 12 byte header, as a name then type and class
+			end := 12
+			for end < len(query) && query[end] != 0 {
+				end += int(query[end]) + 1
+			}
+			end += 5
+			if end > len(query) {
+				continue
+			}
+			resp := append([]byte{}, query[:12]...)
+			binary.BigEndian.PutUint16(resp[2:], 0x8180)
+			binary.BigEndian.PutUint16(resp[4:], 1)
+			binary.BigEndian.PutUint16(resp[6:], uint16(len(records)))
+			binary.BigEndian.PutUint16(resp[8:], 0)
+			binary.BigEndian.PutUint16(resp[10:], 0)
+			resp = append(resp, query[12:end]...)
+			for _, r := range records {
+				var rdata []byte
+				rdata = binary.BigEndian.AppendUint16(rdata, r.priority)
+				rdata = binary.BigEndian.AppendUint16(rdata, r.weight)
+				rdata = binary.BigEndian.AppendUint16(rdata, r.port)
+				for _, label := range strings.Split(strings.TrimSuffix(r.target, "."), ".") {
+					rdata = append(rdata, byte(len(label)))
+					rdata = append(rdata, label...)
+				}
+				rdata = append(rdata, 0)
+				// A pointer to the name in the question, type SRV, class IN, a TTL
+				resp = append(resp, 0xc0, 0x0c, 0, 33, 0, 1, 0, 0, 0, 60)
+				resp = binary.BigEndian.AppendUint16(resp, uint16(len(rdata)))
+				resp = append(resp, rdata...)
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+	return pc.LocalAddr().String()
+}
+
+func TestSRVResolverUsesMostPreferredRecords(t *testing.T) {
+	server := startStubDNS(t, []srvRecord{
+		{priority: 10, weight: 5, port: 5031, target: "a.example.com."},
+		{priority: 10, weight: 5, port: 5032, target: "b.example.com."},
+		{priority: 20, weight: 5, port: 5033, target: "c.example.com."},
+	})
+	r := &SRVResolver{
+		Service: "buffstreams",
+		Proto:   "tcp",
+		Name:    "example.com",
+		Resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "udp", server)
+			},
+		},
+	}
+	addresses, err := r.Resolve(context.Background())
+	if err != nil {
+		t.Fatalf("Expected SRV lookup to succeed, actually got %s", err)
+	}
+	sort.Strings(addresses)
+	if len(addresses) != 2 || addresses[0] != "a.example.com:5031" || addresses[1] != "b.example.com:5032" {
+		t.Errorf("Expected only the priority 10 targets, actually got %v", addresses)
+	}
+}
+
+// swappableResolver returns whatever addresses it was last given
+type swappableResolver struct {
+	lock      sync.Mutex
+	addresses []string
+}
+
+func (r *swappableResolver) set(addresses ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.addresses = addresses
+}
+
+func (r *swappableResolver) Resolve(ctx context.Context) ([]string, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.addresses, nil
+}
+
+// waitForBackends polls the destination until it's backends are addresses
+func waitForBackends(t *testing.T, bm *Manager, name string, addresses ...string) {
+	deadline := time.Now().Add(2 * time.Second)
+	var got []string
+	for time.Now().Before(deadline) {
+		health, _ := bm.DestinationHealth(name)
+		got = got[:0]
+		for _, h := range health {
+			if !h.Ejected {
+				got = append(got, h.Address)
+			}
+		}
+		if strings.Join(got, ",") == strings.Join(addresses, ",") {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Expected backends %v, actually got %v", addresses, got)
+}
+
+func TestDestinationReconcilesResolvedAddresses(t *testing.T) {
+	var firstCount, secondCount atomic.Int32
+	first := startCountingListener(t, 5054, &firstCount)
+	defer first.Close()
+	second := startCountingListener(t, 5055, &secondCount)
+	defer second.Close()
+	firstAddress := FormatAddress("127.0.0.1", strconv.Itoa(5054))
+	secondAddress := FormatAddress("127.0.0.1", strconv.Itoa(5055))
+
+	resolver := &swappableResolver{}
+	resolver.set(firstAddress)
+	var resolveErrors atomic.Int32
+	bm := NewManager()
+	err := bm.AddDestination("consumers", DestinationConfig{
+		Resolver:        resolver,
+		ResolveInterval: 10 * time.Millisecond,
+		OnResolveError:  func(error) { resolveErrors.Add(1) },
+	})
+	if err != nil {
+		t.Fatalf("Failed to add destination: %s", err)
+	}
+	defer bm.RemoveDestination("consumers")
+	waitForBackends(t, bm, "consumers", firstAddress)
+
+	resolver.set(firstAddress, secondAddress)
+	waitForBackends(t, bm, "consumers", firstAddress, secondAddress)
+	for i := 0; i < 4; i++ {
+		bm.WriteDestination("consumers", []byte("hi"))
+	}
+	waitForCount(t, &secondCount, 2)
+
+	// Removing a member closes it's connection
+	resolver.set(secondAddress)
+	waitForBackends(t, bm, "consumers", secondAddress)
+	waitForConnections(t, first, 0)
+
+	// An empty answer is reported, and the current backends are kept
+	resolver.set()
+	deadline := time.Now().Add(time.Second)
+	for resolveErrors.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if resolveErrors.Load() == 0 {
+		t.Errorf("Expected an empty answer to be reported")
+	}
+	waitForBackends(t, bm, "consumers", secondAddress)
+}
@@ -0,0 +1,82 @@
+package buffstreams
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrUnknownSchema is returned by a SchemaValidator when it has no definition
+// for the schema a message declares.
+var ErrUnknownSchema = errors.New("Unknown schema.")
+
+// ErrMissingSchema is the SchemaError reported when RequireSchema is set, and a
+// message does not declare a schema.
+var ErrMissingSchema = errors.New("Message does not declare a schema.")
+
+// Headers used to carry a SchemaRef. The leading colon keeps them apart from
+// any application headers.
+const (
+	schemaIDKey      = ":schema"
+	schemaVersionKey = ":schema-version"
+)
+
+// SchemaRef identifies the schema a message was encoded with, such as the fully
+// qualified name of a protobuf message and the version of the .proto it came from.
+type SchemaRef struct {
+	ID      string
+	Version int
+}
+
+func (r SchemaRef) String() string {
+	return r.ID + "@v" + strconv.Itoa(r.Version)
+}
+
+// WithSchema returns a copy of the headers, which may be nil, recording the
+// schema the message is encoded with.
+func (h Headers) WithSchema(ref SchemaRef) Headers {
+	out := make(Headers, len(h)+2)
+	for key, value := range h {
+		out[key] = value
+	}
+	out[schemaIDKey] = ref.ID
+	out[schemaVersionKey] = strconv.Itoa(ref.Version)
+	return out
+}
+
+// Schema returns the schema the message declares, if any.
+func (h Headers) Schema() (SchemaRef, bool) {
+	id, ok := h[schemaIDKey]
+	if !ok {
+		return SchemaRef{}, false
+	}
+	version, err := strconv.Atoi(h[schemaVersionKey])
+	if err != nil {
+		return SchemaRef{}, false
+	}
+	return SchemaRef{ID: id, Version: version}, true
+}
+
+// SchemaValidator checks a message against the schema it declares, before a
+// TCPListener hands it to a Callback. It should return ErrUnknownSchema, or an
+// error wrapping it, if it has no definition for the schema.
+type SchemaValidator interface {
+	Validate(ref SchemaRef, payload []byte) error
+}
+
+// SchemaError is reported to OnCallbackError when a message is rejected because
+// of it's schema. The Callback is not invoked for the message. Use errors.Is with
+// ErrUnknownSchema to tell a schema the listener doesn't know from a payload
+// that doesn't match it's schema.
+type SchemaError struct {
+	Ref SchemaRef
+	Err error
+}
+
+func (e *SchemaError) Error() string {
+	return fmt.Sprintf("buffstreams: schema %s: %s", e.Ref, e.Err)
+}
+
+func (e *SchemaError) Unwrap() error {
+	return e.Err
+}
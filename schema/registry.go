@@ -0,0 +1,235 @@
+// Package schema provides a local registry of protobuf message schemas, loaded
+// from descriptor sets on disk, that a buffstreams.TCPListener can use to
+// validate incoming messages by the schema version they declare.
+//
+// Descriptor sets are produced by protoc, one per version of your .proto files:
+//
+//	protoc --include_imports --descriptor_set_out=message.v2.pb message.proto
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/StabbyCutyou/buffstreams"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// ErrMalformedPayload is returned by Validate when the payload is not valid
+// protobuf wire format, or a field's wire type doesn't match it's definition.
+var ErrMalformedPayload = errors.New("Payload does not match the schema.")
+
+// ErrMissingRequiredField is returned by Validate when a payload lacks a field
+// the schema marks as required.
+var ErrMissingRequiredField = errors.New("Payload is missing a required field.")
+
+// Registry holds the message definitions of every loaded version. Schema IDs are
+// fully qualified message names without the leading dot, ie: "message.Note".
+// It implements buffstreams.SchemaValidator, and is safe for concurrent use.
+type Registry struct {
+	lock     sync.RWMutex
+	messages map[buffstreams.SchemaRef]*descriptor.DescriptorProto
+}
+
+// NewRegistry creates an empty *Registry
+func NewRegistry() *Registry {
+	return &Registry{
+		messages: make(map[buffstreams.SchemaRef]*descriptor.DescriptorProto),
+	}
+}
+
+// LoadFile reads a serialized FileDescriptorSet from path, and registers every
+// message it defines under version.
+func (r *Registry) LoadFile(path string, version int) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	set := &descriptor.FileDescriptorSet{}
+	if err := proto.Unmarshal(b, set); err != nil {
+		return fmt.Errorf("schema: parsing descriptor set %s: %s", path, err)
+	}
+	r.Add(set, version)
+	return nil
+}
+
+// Add registers every message defined in set, including nested messages,
+// under version. Messages already registered for that version are replaced.
+func (r *Registry) Add(set *descriptor.FileDescriptorSet, version int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, file := range set.GetFile() {
+		prefix := file.GetPackage()
+		for _, msg := range file.GetMessageType() {
+			r.addMessage(prefix, msg, version)
+		}
+	}
+}
+
+func (r *Registry) addMessage(prefix string, msg *descriptor.DescriptorProto, version int) {
+	name := msg.GetName()
+	if prefix != "" {
+		name = prefix + "." + name
+	}
+	r.messages[buffstreams.SchemaRef{ID: name, Version: version}] = msg
+	for _, nested := range msg.GetNestedType() {
+		r.addMessage(name, nested, version)
+	}
+}
+
+// Versions returns every version registered for id, in ascending order.
+func (r *Registry) Versions(id string) []int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var versions []int
+	for ref := range r.messages {
+		if ref.ID == id {
+			versions = append(versions, ref.Version)
+		}
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Validate implements buffstreams.SchemaValidator. It returns
+// buffstreams.ErrUnknownSchema if ref isn't registered. Otherwise it checks that
+// the payload is well formed, that every field it knows about has the expected
+// wire type, recursing into nested messages, and that required fields are present.
+// Fields the schema doesn't define are allowed, as protobuf intends.
+func (r *Registry) Validate(ref buffstreams.SchemaRef, payload []byte) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	msg, ok := r.messages[ref]
+	if !ok {
+		return buffstreams.ErrUnknownSchema
+	}
+	return r.validate(msg, ref.Version, payload, 0)
+}
+
+// Nesting beyond this is treated as malformed, rather than risk the stack
+const maxDepth = 64
+
+func (r *Registry) validate(msg *descriptor.DescriptorProto, version int, b []byte, depth int) error {
+	if depth > maxDepth {
+		return ErrMalformedPayload
+	}
+	fields := make(map[int32]*descriptor.FieldDescriptorProto, len(msg.GetField()))
+	for _, f := range msg.GetField() {
+		fields[f.GetNumber()] = f
+	}
+	seen := make(map[int32]bool)
+
+	for len(b) > 0 {
+		tag, n := proto.DecodeVarint(b)
+		if n == 0 {
+			return ErrMalformedPayload
+		}
+		b = b[n:]
+		number, wireType := int32(tag>>3), int(tag&7)
+		value, rest, err := splitField(b, wireType)
+		if err != nil {
+			return err
+		}
+		b = rest
+		seen[number] = true
+
+		f, ok := fields[number]
+		if !ok {
+			continue
+		}
+		if !wireTypeMatches(f, wireType) {
+			return fmt.Errorf("%w: field %s has wire type %d", ErrMalformedPayload, f.GetName(), wireType)
+		}
+		if f.GetType() == descriptor.FieldDescriptorProto_TYPE_MESSAGE {
+			nested, ok := r.messages[buffstreams.SchemaRef{ID: strings.TrimPrefix(f.GetTypeName(), "."), Version: version}]
+			if !ok {
+				// Only possible if the descriptor set was built without --include_imports
+				continue
+			}
+			if err := r.validate(nested, version, value, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range msg.GetField() {
+		if f.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REQUIRED && !seen[f.GetNumber()] {
+			return fmt.Errorf("%w: %s", ErrMissingRequiredField, f.GetName())
+		}
+	}
+	return nil
+}
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// splitField returns the encoded value of a field of the given wire type from
+// the front of b, and what follows it
+func splitField(b []byte, wireType int) ([]byte, []byte, error) {
+	switch wireType {
+	case wireVarint:
+		_, n := proto.DecodeVarint(b)
+		if n == 0 {
+			return nil, nil, ErrMalformedPayload
+		}
+		return b[:n], b[n:], nil
+	case wireFixed64:
+		if len(b) < 8 {
+			return nil, nil, ErrMalformedPayload
+		}
+		return b[:8], b[8:], nil
+	case wireBytes:
+		length, n := proto.DecodeVarint(b)
+		if n == 0 || length > uint64(len(b)-n) {
+			return nil, nil, ErrMalformedPayload
+		}
+		end := n + int(length)
+		return b[n:end], b[end:], nil
+	case wireFixed32:
+		if len(b) < 4 {
+			return nil, nil, ErrMalformedPayload
+		}
+		return b[:4], b[4:], nil
+	default:
+		// Groups are deprecated, and not supported
+		return nil, nil, fmt.Errorf("%w: unsupported wire type %d", ErrMalformedPayload, wireType)
+	}
+}
+
+// wireTypeMatches reports whether a field of f's type may be encoded with wireType.
+// Repeated scalars may also be packed, which uses the bytes wire type.
+func wireTypeMatches(f *descriptor.FieldDescriptorProto, wireType int) bool {
+	var expected int
+	switch f.GetType() {
+	case descriptor.FieldDescriptorProto_TYPE_STRING,
+		descriptor.FieldDescriptorProto_TYPE_BYTES,
+		descriptor.FieldDescriptorProto_TYPE_MESSAGE:
+		return wireType == wireBytes
+	case descriptor.FieldDescriptorProto_TYPE_DOUBLE,
+		descriptor.FieldDescriptorProto_TYPE_FIXED64,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED64:
+		expected = wireFixed64
+	case descriptor.FieldDescriptorProto_TYPE_FLOAT,
+		descriptor.FieldDescriptorProto_TYPE_FIXED32,
+		descriptor.FieldDescriptorProto_TYPE_SFIXED32:
+		expected = wireFixed32
+	case descriptor.FieldDescriptorProto_TYPE_GROUP:
+		return false
+	default:
+		expected = wireVarint
+	}
+	if wireType == expected {
+		return true
+	}
+	return wireType == wireBytes && f.GetLabel() == descriptor.FieldDescriptorProto_LABEL_REPEATED
+}
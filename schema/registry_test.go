@@ -0,0 +1,185 @@
+package schema
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/StabbyCutyou/buffstreams"
+	"github.com/StabbyCutyou/buffstreams/test/message"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+)
+
+// noteDescriptorSet mirrors test/message/message.proto. Version 2 adds a
+// repeated tags field, and a nested Author message.
+func noteDescriptorSet(version int) *descriptor.FileDescriptorSet {
+	field := func(name string, number int32, label descriptor.FieldDescriptorProto_Label, typ descriptor.FieldDescriptorProto_Type) *descriptor.FieldDescriptorProto {
+		return &descriptor.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Label: &label, Type: &typ}
+	}
+	req, opt, rep := descriptor.FieldDescriptorProto_LABEL_REQUIRED, descriptor.FieldDescriptorProto_LABEL_OPTIONAL, descriptor.FieldDescriptorProto_LABEL_REPEATED
+	note := &descriptor.DescriptorProto{
+		Name: proto.String("Note"),
+		Field: []*descriptor.FieldDescriptorProto{
+			field("name", 1, req, descriptor.FieldDescriptorProto_TYPE_STRING),
+			field("date", 2, req, descriptor.FieldDescriptorProto_TYPE_INT64),
+			field("comment", 3, req, descriptor.FieldDescriptorProto_TYPE_STRING),
+		},
+	}
+	if version >= 2 {
+		author := field("author", 5, opt, descriptor.FieldDescriptorProto_TYPE_MESSAGE)
+		author.TypeName = proto.String(".message.Note.Author")
+		note.Field = append(note.Field, field("tags", 4, rep, descriptor.FieldDescriptorProto_TYPE_STRING), author)
+		note.NestedType = []*descriptor.DescriptorProto{{
+			Name:  proto.String("Author"),
+			Field: []*descriptor.FieldDescriptorProto{field("id", 1, req, descriptor.FieldDescriptorProto_TYPE_INT32)},
+		}}
+	}
+	return &descriptor.FileDescriptorSet{File: []*descriptor.FileDescriptorProto{{
+		Name:        proto.String("message.proto"),
+		Package:     proto.String("message"),
+		MessageType: []*descriptor.DescriptorProto{note},
+	}}}
+}
+
+func loadedRegistry(t *testing.T) *Registry {
+	dir := t.TempDir()
+	r := NewRegistry()
+	for _, version := range []int{1, 2} {
+		b, err := proto.Marshal(noteDescriptorSet(version))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "message.v"+strconv.Itoa(version)+".pb")
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.LoadFile(path, version); err != nil {
+			t.Fatalf("Failed to load %s: %s", path, err)
+		}
+	}
+	return r
+}
+
+func noteBytes(t *testing.T) []byte {
+	name, date, comment := "Stabby", time.Now().UnixNano(), "hello"
+	b, err := proto.Marshal(&message.Note{Name: &name, Date: &date, Comment: &comment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRegistryValidate(t *testing.T) {
+	r := loadedRegistry(t)
+	if versions := r.Versions("message.Note"); len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+		t.Errorf("Expected versions [1 2], actually got %v", versions)
+	}
+	if versions := r.Versions("message.Note.Author"); len(versions) != 1 {
+		t.Errorf("Expected the nested message to be registered once, actually got %v", versions)
+	}
+
+	note := noteBytes(t)
+	v1, v2 := buffstreams.SchemaRef{ID: "message.Note", Version: 1}, buffstreams.SchemaRef{ID: "message.Note", Version: 2}
+	if err := r.Validate(v1, note); err != nil {
+		t.Errorf("Expected a v1 note to be valid, actually got %s", err)
+	}
+	// A v2 producer sending tags and an author to a v1 consumer is still valid
+	v2Note := append(append(append([]byte{}, note...), 0x22, 1, 'x'), 0x2a, 2, 0x08, 7)
+	if err := r.Validate(v1, v2Note); err != nil {
+		t.Errorf("Expected unknown fields to be allowed, actually got %s", err)
+	}
+	if err := r.Validate(v2, v2Note); err != nil {
+		t.Errorf("Expected a v2 note to be valid, actually got %s", err)
+	}
+
+	cases := []struct {
+		name    string
+		ref     buffstreams.SchemaRef
+		payload []byte
+		err     error
+	}{
+		{"unknown version", buffstreams.SchemaRef{ID: "message.Note", Version: 3}, note, buffstreams.ErrUnknownSchema},
+		{"unknown id", buffstreams.SchemaRef{ID: "message.Other", Version: 1}, note, buffstreams.ErrUnknownSchema},
+		{"truncated", v1, note[:len(note)-1], ErrMalformedPayload},
+		{"wrong wire type", v1, append([]byte{0x08, 1}, note[2:]...), ErrMalformedPayload},
+		{"missing required", v1, []byte{0x10, 1}, ErrMissingRequiredField},
+		{"nested missing required", v2, append(append([]byte{}, note...), 0x2a, 0), ErrMissingRequiredField},
+	}
+	for _, c := range cases {
+		if err := r.Validate(c.ref, c.payload); !errors.Is(err, c.err) {
+			t.Errorf("%s: Expected %v, actually got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestListenerValidatesAndRoutesBySchema(t *testing.T) {
+	r := loadedRegistry(t)
+	v1Messages, v2Messages := make(chan []byte, 1), make(chan []byte, 1)
+	schemaErrors := make(chan error, 2)
+	cfg := buffstreams.TCPListenerConfig{
+		Address:         buffstreams.FormatAddress("", strconv.Itoa(5047)),
+		EnableMetadata:  true,
+		SchemaValidator: r,
+		Callback: func(b []byte) error {
+			v1Messages <- append([]byte{}, b...)
+			return nil
+		},
+		SchemaCallbacks: map[buffstreams.SchemaRef]buffstreams.ListenCallback{
+			{ID: "message.Note", Version: 2}: func(b []byte) error {
+				v2Messages <- append([]byte{}, b...)
+				return nil
+			},
+		},
+		OnCallbackError: func(_ buffstreams.ConnectionInfo, err error) { schemaErrors <- err },
+	}
+	l, err := buffstreams.ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	connCfg := buffstreams.TCPConnConfig{
+		Address:        buffstreams.FormatAddress("127.0.0.1", strconv.Itoa(5047)),
+		EnableMetadata: true,
+	}
+	c, err := buffstreams.DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+
+	note := noteBytes(t)
+	send := func(version int, payload []byte) {
+		h := buffstreams.Headers(nil).WithSchema(buffstreams.SchemaRef{ID: "message.Note", Version: version})
+		if _, err := c.WriteWithHeaders(h, payload); err != nil {
+			t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+		}
+	}
+	send(3, note)
+	send(1, []byte{0x10, 1})
+	send(1, note)
+	send(2, note)
+
+	for _, expectUnknown := range []bool{true, false} {
+		select {
+		case err := <-schemaErrors:
+			var schemaErr *buffstreams.SchemaError
+			if !errors.As(err, &schemaErr) || errors.Is(err, buffstreams.ErrUnknownSchema) != expectUnknown {
+				t.Errorf("Expected a *SchemaError, unknown schema %v, actually got %v", expectUnknown, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a schema error")
+		}
+	}
+	for version, ch := range map[int]chan []byte{1: v1Messages, 2: v2Messages} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the v%d note to be routed to it's callback", version)
+		}
+	}
+}
@@ -1,10 +1,18 @@
 package buffstreams
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -12,24 +20,155 @@ var (
 	ErrZeroBytesReadHeader = errors.New("0 Bytes parsed from header. Connection Closed")
 	// ErrLessThanZeroBytesReadHeader is thrown when the value parsed from the header caused some kind of underrun
 	ErrLessThanZeroBytesReadHeader = errors.New("Less than zero bytes parsed from header. Connection Closed")
+	// ErrMetadataDisabled is returned when writing headers to a connection that doesn't have EnableMetadata set,
+	// or configuring a KeyRing or requiring protection without it
+	ErrMetadataDisabled = errors.New("EnableMetadata must be set to write headers.")
+	// ErrHeadersTooLarge is returned when the encoded headers of an outgoing message exceed MaxHeaderSize
+	ErrHeadersTooLarge = errors.New("Encoded headers exceed MaxHeaderSize.")
+	// ErrInvalidMaxHeaderSize is returned when a config sets MaxHeaderSize above the 65535 bytes a frame can describe
+	ErrInvalidMaxHeaderSize = errors.New("MaxHeaderSize may not exceed 65535 bytes.")
+	// ErrConnectionClosed is returned when reading from or writing to a connection that is not connected
+	ErrConnectionClosed = errors.New("The connection is closed.")
+	// ErrMessageTooLarge is wrapped by the MessageSizeError for a message outside 1 to MaxMessageSize bytes
+	ErrMessageTooLarge = errors.New("Message size is outside 1 to MaxMessageSize bytes.")
+	// ErrFrameTimeout is returned when the rest of a frame doesn't arrive within FrameReadTimeout. Connection Closed
+	ErrFrameTimeout = errors.New("Frame was not received within FrameReadTimeout. Connection Closed")
+	// ErrReadTooSlow is returned when a frame arrives slower than MinReadRate. Connection Closed
+	ErrReadTooSlow = errors.New("Frame was received slower than MinReadRate. Connection Closed")
 )
 
+// DefaultMinReadRateGrace is the time a frame is allowed on top of it's size
+// divided by the MinReadRate, so small frames aren't held to an unrealistic
+// deadline by the latency of the network.
+const DefaultMinReadRateGrace = time.Second
+
+// MessageSizeError is returned when writing a message, or reading a frame that
+// declares a message, outside 1 to MaxMessageSize bytes. A read that fails with
+// it closes the connection, as the rest of the stream can't be trusted. Use
+// errors.Is with ErrMessageTooLarge to detect it.
+type MessageSizeError struct {
+	// Size is the size of the message, or of the whole frame if it's too large
+	// to be read at all
+	Size int64
+	// Max is the limit Size exceeded. For a whole frame, it includes room for
+	// the largest metadata section and encryption on top of MaxMessageSize
+	Max int
+}
+
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("buffstreams: message size %d is outside 1 to %d bytes", e.Size, e.Max)
+}
+
+func (e *MessageSizeError) Unwrap() error {
+	return ErrMessageTooLarge
+}
+
+// ConnState describes where a TCPConn is in it's lifecycle.
+type ConnState int32
+
+const (
+	// StateConnecting is a connection being dialed, by DialTCP or Reopen
+	StateConnecting ConnState = iota
+	// StateConnected is a connection that can be read from and written to
+	StateConnected
+	// StateClosing is a connection whose socket is being closed
+	StateClosing
+	// StateClosed is a connection that has been closed, explicitly or by a failed
+	// read or write. Reopen brings it back to StateConnected, but the automatic
+	// reconnects made by a Manager only revive connections that weren't closed
+	// explicitly.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
 // TCPConn is an abstraction over the normal net.TCPConn, but optimized for wtiting
 // data encoded in a length+data format, like you would treat networked protocol
 // buffer messages
 type TCPConn struct {
-	// General
-	socket         *net.TCPConn
+	// General. The socket is replaced by Reopen, so it and the state are read
+	// together under the stateLock, see current
+	socket     *net.TCPConn
+	state      ConnState
+	stateLock  sync.Mutex
+	reopenLock sync.Mutex
+	// closedByUser is set by Close, so only Reopen can bring the connection back
+	closedByUser   bool
 	address        string
 	headerByteSize int
 	maxMessageSize int
+	maxFrameSize   int
+
+	// Frame metadata, see EnableMetadata
+	enableMetadata  bool
+	maxMetadataSize int
+	tracer          Tracer
+
+	// Message protection, see KeyRing
+	keys              *KeyRing
+	requireEncryption bool
+	requireSignature  bool
+
+	logger  *logger
+	metrics Metrics
+
+	// Optional hooks, see TCPConnConfig
+	onDial       func(string, error)
+	onReconnect  func(string, error)
+	onWriteError func(string, error)
+
+	credentials Credentials
+	authTimeout time.Duration
+
+	// Only set for connections accepted by a TCPListener
+	id          uint64
+	connectedAt time.Time
+	principal   string
+	kicked      atomic.Bool
+	// For clients relayed by a trusted proxy, the address it reported and the
+	// proxy's own
+	clientAddress netip.AddrPort
+	proxyAddress  string
 
 	// For processing incoming data
-	incomingHeaderBuffer []byte
+	readLock               sync.Mutex
+	incomingHeaderBuffer   []byte
+	incomingMetadataBuffer []byte
+	incomingSealedBuffer   []byte
+	incomingSignedBuffer   []byte
+	frameReadTimeout       time.Duration
+	minReadRate            int
+
+	// A listener shutting down interrupts the handshake reads of a connection
+	// it hasn't accepted yet with a deadline in the past, which nothing may then
+	// push back out. Connections it is serving are draining instead, and only
+	// have their reads cut short while idle between frames
+	deadlineLock sync.Mutex
+	interrupted  bool
+	draining     bool
+	idle         bool
 
 	// For processing outgoing data
-	writeLock          sync.Mutex
-	outgoingDataBuffer []byte
+	writeLock              sync.Mutex
+	outgoingHeaderBuffer   []byte
+	outgoingMetadataBuffer []byte
+	outgoingSealedBuffer   []byte
+	outgoingSignedBuffer   []byte
+	outgoingVectors        [3][]byte
+	outgoingBuffers        net.Buffers
 }
 
 // TCPConnConfig representss the information needed to begin listening for
@@ -40,6 +179,51 @@ type TCPConnConfig struct {
 	MaxMessageSize int
 	// Address is the address to connect to for writing streaming messages.
 	Address string
+	// Logger optionally receives structured events for dialing, reconnecting and
+	// write failures. If it is nil, nothing is logged
+	Logger slog.Handler
+	// Metrics optionally records messages, bytes, errors and reconnects for
+	// the connection, labeled with Address
+	Metrics Metrics
+	// EnableMetadata adds a metadata section to every frame, used to carry headers
+	// and propagate trace context. The server must have the same setting for this to work.
+	EnableMetadata bool
+	// MaxHeaderSize controls how large the encoded headers of a single message may
+	// be, including any trace context. It must match the server's configuration.
+	MaxHeaderSize int
+	// Tracer is optionally invoked around each Write and WriteContext
+	Tracer Tracer
+	// FrameReadTimeout optionally limits how long a Read waits for the rest of
+	// a frame, once it's first byte has arrived. Waiting for a frame to begin is
+	// never limited.
+	FrameReadTimeout time.Duration
+	// MinReadRate optionally closes the connection if a frame arrives slower than
+	// this many bytes per second, once it has begun, after allowing
+	// DefaultMinReadRateGrace for the network.
+	MinReadRate int
+	// Credentials are optionally presented to the listeners Authenticator each
+	// time the connection is dialed
+	Credentials Credentials
+	// AuthTimeout limits how long authenticating may take. 0 uses DefaultAuthTimeout.
+	AuthTimeout time.Duration
+	// KeyRing optionally encrypts and signs each message written, and decrypts and
+	// verifies each message read. It requires EnableMetadata, and the fields it
+	// adds count against MaxHeaderSize.
+	KeyRing *KeyRing
+	// RequireEncryption rejects any message read that isn't encrypted
+	RequireEncryption bool
+	// RequireSignature rejects any message read that isn't signed
+	RequireSignature bool
+
+	// OnDial is optionally invoked with the address and the result of the
+	// initial dial made by DialTCP. The error is nil if the dial succeeded.
+	OnDial func(address string, err error)
+	// OnReconnect is optionally invoked with the address and the result of
+	// each call to Reopen. The error is nil if the connection was re-established.
+	OnReconnect func(address string, err error)
+	// OnWriteError is optionally invoked with the address and the error each
+	// time a Write fails. The connection will have been closed.
+	OnWriteError func(address string, err error)
 }
 
 func newTCPConn(cfg *TCPConnConfig) (*TCPConn, error) {
@@ -49,15 +233,61 @@ func newTCPConn(cfg *TCPConnConfig) (*TCPConn, error) {
 		maxMessageSize = cfg.MaxMessageSize
 	}
 
-	headerByteSize := messageSizeToBitLength(maxMessageSize)
+	// With metadata, the size header has to be able to describe the largest
+	// metadata section on top of the largest message
+	maxFrameSize := maxMessageSize
+	maxMetadataSize := 0
+	if cfg.EnableMetadata {
+		maxMetadataSize = DefaultMaxHeaderSize
+		if cfg.MaxHeaderSize != 0 {
+			maxMetadataSize = cfg.MaxHeaderSize
+		}
+		// The length of the section has to fit in it's 2 byte prefix
+		if maxMetadataSize > math.MaxUint16 {
+			return nil, ErrInvalidMaxHeaderSize
+		}
+		maxFrameSize += metadataLengthSize + maxMetadataSize
+	}
+	headerByteSize := messageSizeToBitLength(maxFrameSize)
+	if (cfg.KeyRing != nil || cfg.RequireEncryption || cfg.RequireSignature) && !cfg.EnableMetadata {
+		return nil, ErrMetadataDisabled
+	}
+	// The header always has room to spare, so making room for the encryption
+	// doesn't change it's size, and a connection without a KeyRing can still
+	// talk to one with
+	var sealedBuffer []byte
+	if cfg.KeyRing != nil {
+		maxFrameSize += sealOverhead
+		sealedBuffer = make([]byte, maxMessageSize+sealOverhead)
+	}
 
 	return &TCPConn{
-		maxMessageSize:       maxMessageSize,
-		headerByteSize:       headerByteSize,
-		address:              cfg.Address,
-		incomingHeaderBuffer: make([]byte, headerByteSize),
-		writeLock:            sync.Mutex{},
-		outgoingDataBuffer:   make([]byte, maxMessageSize),
+		maxMessageSize:         maxMessageSize,
+		maxFrameSize:           maxFrameSize,
+		headerByteSize:         headerByteSize,
+		enableMetadata:         cfg.EnableMetadata,
+		maxMetadataSize:        maxMetadataSize,
+		tracer:                 cfg.Tracer,
+		keys:                   cfg.KeyRing,
+		requireEncryption:      cfg.RequireEncryption,
+		requireSignature:       cfg.RequireSignature,
+		address:                cfg.Address,
+		logger:                 newLogger(cfg.Logger, false),
+		metrics:                cfg.Metrics,
+		onDial:                 cfg.OnDial,
+		onReconnect:            cfg.OnReconnect,
+		onWriteError:           cfg.OnWriteError,
+		credentials:            cfg.Credentials,
+		authTimeout:            cfg.AuthTimeout,
+		incomingHeaderBuffer:   make([]byte, headerByteSize),
+		incomingMetadataBuffer: make([]byte, metadataLengthSize+maxMetadataSize),
+		incomingSealedBuffer:   sealedBuffer,
+		frameReadTimeout:       cfg.FrameReadTimeout,
+		minReadRate:            cfg.MinReadRate,
+		writeLock:              sync.Mutex{},
+		outgoingHeaderBuffer:   make([]byte, headerByteSize),
+		outgoingMetadataBuffer: make([]byte, 0, metadataLengthSize+maxMetadataSize),
+		outgoingSealedBuffer:   append([]byte(nil), sealedBuffer...),
 	}, nil
 }
 
@@ -68,7 +298,16 @@ func DialTCP(cfg *TCPConnConfig) (*TCPConn, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := c.open(); err != nil {
+	err = c.open()
+	if err != nil {
+		c.logger.log(slog.LevelError, "dial failed", slog.String("address", c.address), errAttrs(err))
+	} else {
+		c.logger.log(slog.LevelInfo, "dialed", slog.String("address", c.address))
+	}
+	if c.onDial != nil {
+		c.onDial(c.address, err)
+	}
+	if err != nil {
 		return nil, err
 	}
 	return c, nil
@@ -84,21 +323,117 @@ func (c *TCPConn) open() error {
 	if err != nil {
 		return err
 	}
+	// Authenticate before the socket is published, so nothing else can use it
+	if c.credentials != nil {
+		if err := respond(conn, c.credentials, c.authTimeout); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	c.stateLock.Lock()
+	if c.state != StateConnecting {
+		// Closed while we were dialing
+		c.stateLock.Unlock()
+		conn.Close()
+		return ErrConnectionClosed
+	}
 	c.socket = conn
-	return err
+	c.connectedAt = time.Now()
+	c.state = StateConnected
+	c.stateLock.Unlock()
+	if c.metrics != nil {
+		c.metrics.ConnectionOpened(c.address)
+	}
+	return nil
+}
+
+// current returns the socket, and the state of the connection
+func (c *TCPConn) current() (*net.TCPConn, ConnState) {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.socket, c.state
+}
+
+// connectedTime returns when the current socket was connected
+func (c *TCPConn) connectedTime() time.Time {
+	c.stateLock.Lock()
+	defer c.stateLock.Unlock()
+	return c.connectedAt
+}
+
+// State returns where the connection is in it's lifecycle.
+func (c *TCPConn) State() ConnState {
+	_, state := c.current()
+	return state
 }
 
 // Reopen allows you to close and re-establish a connection to the existing Address
-// without needing to create a whole new TCPWriter object.
+// without needing to create a whole new TCPWriter object. It is safe to call
+// while other goroutines are reading and writing, whose operations in progress
+// fail with the old socket. Concurrent calls to Reopen take turns.
 func (c *TCPConn) Reopen() error {
-	if err := c.Close(); err != nil {
+	c.reopenLock.Lock()
+	defer c.reopenLock.Unlock()
+	return c.reopenLocked(true)
+}
+
+// reconnect reopens the connection, unless it is already connected, or was
+// closed explicitly, which returns ErrConnectionClosed. When many writers fail
+// on the same socket, only the first to get here replaces it, and the rest find
+// it connected again, rather than each replacing the last ones.
+func (c *TCPConn) reconnect() error {
+	c.reopenLock.Lock()
+	defer c.reopenLock.Unlock()
+	if c.State() == StateConnected {
+		return nil
+	}
+	return c.reopenLocked(false)
+}
+
+// reopenLocked must be called with the reopenLock held. Unless revive is set,
+// a connection closed explicitly is left closed.
+func (c *TCPConn) reopenLocked(revive bool) error {
+	err := c.reopen(revive)
+	if err == ErrConnectionClosed && !revive {
+		// Nothing was attempted
 		return err
 	}
+	if err != nil {
+		c.logger.log(slog.LevelError, "reconnect failed", slog.String("address", c.address), errAttrs(err))
+	} else {
+		c.logger.log(slog.LevelInfo, "reconnected", slog.String("address", c.address))
+	}
+	if c.onReconnect != nil {
+		c.onReconnect(c.address, err)
+	}
+	return err
+}
+
+func (c *TCPConn) reopen(revive bool) error {
+	// The old socket is replaced whether or not it closes cleanly
+	c.close(nil)
+	// Checked along with the change of state, so a concurrent Close can't be missed
+	c.stateLock.Lock()
+	if c.closedByUser && !revive {
+		c.stateLock.Unlock()
+		return ErrConnectionClosed
+	}
+	c.closedByUser = false
+	c.state = StateConnecting
+	c.stateLock.Unlock()
 
 	if err := c.open(); err != nil {
+		c.stateLock.Lock()
+		if c.state == StateConnecting {
+			c.state = StateClosed
+		}
+		c.stateLock.Unlock()
 		return err
 	}
 
+	if c.metrics != nil {
+		c.metrics.Reconnected(c.address)
+	}
 	return nil
 }
 
@@ -106,21 +441,157 @@ func (c *TCPConn) Reopen() error {
 // the golang source code for the netFD object, this call uses a special mutex to
 // control access to the underlying pool of readers/writers. This call should be
 // threadsafe, so that any other threads writing will finish, or be blocked, when
-// this is invoked.
+// this is invoked. Closing a connection that is already closed does nothing. If
+// a Reopen is dialing, it is abandoned. Only Reopen brings it back afterwards.
 func (c *TCPConn) Close() error {
-	return c.socket.Close()
+	c.stateLock.Lock()
+	c.closedByUser = true
+	c.stateLock.Unlock()
+	return c.close(nil)
+}
+
+// close closes the connection. If sock is set, it is only closed if it is still
+// the current socket, so a failed read or write can't close the socket a
+// concurrent Reopen has replaced it with.
+func (c *TCPConn) close(sock *net.TCPConn) error {
+	c.stateLock.Lock()
+	if sock != nil && sock != c.socket {
+		c.stateLock.Unlock()
+		return nil
+	}
+	switch c.state {
+	case StateClosing, StateClosed:
+		c.stateLock.Unlock()
+		return nil
+	case StateConnecting:
+		if sock != nil {
+			// A failure on the old socket, which Reopen is already replacing
+			c.stateLock.Unlock()
+			return nil
+		}
+		// There's no socket yet, and open will see it's no longer wanted
+		c.state = StateClosed
+		c.stateLock.Unlock()
+		return nil
+	}
+	c.state = StateClosing
+	sock = c.socket
+	c.stateLock.Unlock()
+
+	err := sock.Close()
+	c.stateLock.Lock()
+	if c.state == StateClosing {
+		c.state = StateClosed
+	}
+	c.stateLock.Unlock()
+	if err == nil && c.metrics != nil {
+		c.metrics.ConnectionClosed(c.address)
+	}
+	return err
 }
 
 // Write allows you to send a stream of bytes as messages. Each array of bytes
 // you pass in will be pre-pended with it's size. If the connection isn't open
-// you will receive an error. If not all bytes can be written, Write will keep
+// you will receive ErrConnectionClosed. If not all bytes can be written, Write will keep
 // trying until the full message is delivered, or the connection is broken.
+// Concurrent Writes are safe, and each frame is written whole, never interleaved
+// with another. If a Tracer is configured, Write is traced as a WriteContext
+// with no parent span.
 func (c *TCPConn) Write(data []byte) (int, error) {
+	if c.tracer != nil {
+		return c.WriteContext(context.Background(), data)
+	}
+	// Frames from concurrent writers, such as a TCPListener Broadcast racing a
+	// SendTo on the same connection, must not interleave on the wire
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if c.enableMetadata {
+		return c.writeFrame(c.beginMetadata(), data)
+	}
+	return c.writeFrame(nil, data)
+}
+
+// WriteWithHeaders behaves like Write, but sends headers along with the message.
+// It returns ErrMetadataDisabled unless EnableMetadata is set, and ErrHeadersTooLarge
+// if the encoded headers exceed MaxHeaderSize.
+func (c *TCPConn) WriteWithHeaders(headers Headers, data []byte) (int, error) {
+	if !c.enableMetadata {
+		return 0, ErrMetadataDisabled
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.writeFrame(headers.appendTo(c.beginMetadata()), data)
+}
+
+// WriteContext behaves like Write, but invokes the configured Tracer around the
+// write. When EnableMetadata is set, any Headers carried by ctx are sent with the
+// message, and the TraceContext carried by ctx (or by the span the Tracer started)
+// is propagated with it.
+func (c *TCPConn) WriteContext(ctx context.Context, data []byte) (int, error) {
+	var finish func(error)
+	if c.tracer != nil {
+		ctx, finish = c.tracer.StartWrite(ctx, c.address, len(data))
+	}
+	c.writeLock.Lock()
+	var metadata []byte
+	if c.enableMetadata {
+		metadata = HeadersFromContext(ctx).appendTo(c.beginMetadata())
+		if tc, ok := TraceFromContext(ctx); ok {
+			metadata = appendMetadataField(metadata, traceparentKey, tc.String())
+		}
+	}
+	n, err := c.writeFrame(metadata, data)
+	c.writeLock.Unlock()
+	if finish != nil {
+		finish(err)
+	}
+	return n, err
+}
+
+// beginMetadata returns the outgoing metadata scratch space, with room reserved
+// for the length of the section. Must be called with the writeLock held
+func (c *TCPConn) beginMetadata() []byte {
+	return c.outgoingMetadataBuffer[:metadataLengthSize]
+}
+
+// writeFrame writes a single frame. metadata is nil when EnableMetadata is not
+// set, and otherwise begins with the space reserved by beginMetadata. Must be
+// called with the writeLock held
+func (c *TCPConn) writeFrame(metadata []byte, data []byte) (int, error) {
+	sock, state := c.current()
+	if state != StateConnected {
+		return 0, ErrConnectionClosed
+	}
+	if len(data) < 1 || len(data) > c.maxMessageSize {
+		return 0, &MessageSizeError{Size: int64(len(data)), Max: c.maxMessageSize}
+	}
+	if c.keys != nil {
+		var err error
+		if metadata, data, err = c.protect(metadata, data); err != nil {
+			return 0, err
+		}
+	}
+	frameSize := len(data)
+	if c.enableMetadata {
+		if len(metadata)-metadataLengthSize > c.maxMetadataSize {
+			return 0, ErrHeadersTooLarge
+		}
+		binary.BigEndian.PutUint16(metadata, uint16(len(metadata)-metadataLengthSize))
+		frameSize += len(metadata)
+	}
+
 	// Calculate how big the message is, using a consistent header size.
-	// Append the size to the message, so now it has a header
-	c.outgoingDataBuffer = append(intToByteArray(int64(len(data)), c.headerByteSize), data...)
+	// The header is encoded into scratch space owned by the connection, so
+	// no new slices are created on each call
+	putHeader(c.outgoingHeaderBuffer, int64(frameSize))
 
-	toWriteLen := len(c.outgoingDataBuffer)
+	// Rather than copying the payload behind the header, hand the slices to
+	// the socket as a single vectored write. net.Buffers consumes the slice
+	// it writes from, so it is rebuilt from the fixed backing array each time
+	c.outgoingVectors[0] = c.outgoingHeaderBuffer
+	c.outgoingVectors[1] = metadata
+	c.outgoingVectors[2] = data
+	c.outgoingBuffers = c.outgoingVectors[:]
 
 	// Three conditions could have occured:
 	// 1. There was an error
@@ -134,42 +605,54 @@ func (c *TCPConn) Write(data []byte) (int, error) {
 
 	// TODO configurable message retries
 
-	// If there was not an error, and we simply didn't finish the write, we should enter
-	// a write-until-complete loop, where we continue to write the data until the server accepts
-	// all of it.
+	// If there was not an error, and we simply didn't finish the write, WriteTo
+	// will continue to write the remaining data until the server accepts all of it.
+	totalBytesWritten, writeError := c.outgoingBuffers.WriteTo(sock)
 
-	// If both issues occurred, we'll need to find a way to determine if the error
-	// is recoverable (is the connection in a bad state) or not.
-
-	var writeError error
-	var totalBytesWritten = 0
-	var bytesWritten = 0
-	// First, read the number of bytes required to determine the message length
-	for totalBytesWritten < toWriteLen && writeError == nil {
-		// While we haven't read enough yet
-		// If there are remainder bytes, adjust the contents of toWrite
-		// totalBytesWritten will be the index of the nextByte waiting to be read
-		bytesWritten, writeError = c.socket.Write(c.outgoingDataBuffer[totalBytesWritten:])
-		totalBytesWritten += bytesWritten
-	}
+	// Don't hold on to the callers data past the end of the call
+	c.outgoingVectors[2] = nil
 	if writeError != nil {
-		c.Close()
+		c.close(sock)
+		if c.metrics != nil {
+			c.metrics.WriteError(c.address, errorKind(writeError))
+		}
+		c.logger.log(slog.LevelWarn, "write failed", slog.String("address", c.address),
+			slog.Int("frame_size", len(data)), errAttrs(writeError))
+		if c.onWriteError != nil {
+			c.onWriteError(c.address, writeError)
+		}
+	} else {
+		if c.metrics != nil {
+			c.metrics.MessageWritten(c.address, len(data))
+		}
+		if c.logger.enabled(slog.LevelDebug) {
+			c.logger.log(slog.LevelDebug, "frame written", slog.String("address", c.address), slog.Int("frame_size", len(data)))
+		}
 	}
 
 	// Return the bytes written, any error
-	return totalBytesWritten, writeError
+	return int(totalBytesWritten), writeError
+}
+
+// brokenBy reports whether a failed write left the connection unusable, rather
+// than refusing the message before any of it was sent
+func (c *TCPConn) brokenBy(err error) bool {
+	if err == nil || errors.Is(err, ErrMessageTooLarge) || err == ErrHeadersTooLarge {
+		return false
+	}
+	return c.State() != StateConnected
 }
 
-func (c *TCPConn) lowLevelRead(buffer []byte) (int, error) {
+func lowLevelRead(sock *net.TCPConn, buffer []byte) (int, error) {
 	var totalBytesRead = 0
 	var err error
 	var bytesRead = 0
 	var toRead = len(buffer)
 	// This fills the buffer
-	bytesRead, err = c.socket.Read(buffer)
+	bytesRead, err = sock.Read(buffer)
 	totalBytesRead += bytesRead
 	for totalBytesRead < toRead && err == nil {
-		bytesRead, err = c.socket.Read(buffer[totalBytesRead:])
+		bytesRead, err = sock.Read(buffer[totalBytesRead:])
 		totalBytesRead += bytesRead
 	}
 
@@ -189,28 +672,233 @@ func (c *TCPConn) lowLevelRead(buffer []byte) (int, error) {
 	return totalBytesRead, nil
 }
 
+// Read reads a single message into b, stripped of it's size header, and returns
+// the size of the message. Any frame metadata is discarded. Concurrent Reads are
+// safe, and each receives a whole message. If the connection isn't open you will
+// receive ErrConnectionClosed. A frame declaring a message outside 1 to
+// MaxMessageSize bytes fails with a *MessageSizeError, and one larger than b
+// with io.ErrShortBuffer, either of which closes the connection.
 func (c *TCPConn) Read(b []byte) (int, error) {
-	// Read the header
-	hLength, err := c.lowLevelRead(c.incomingHeaderBuffer)
+	n, _, err := c.readMessage(b)
+	return n, err
+}
+
+// readMessage reads a single message into b, returning it's size and it's
+// metadata section, if EnableMetadata is set. The metadata is only valid
+// until the next read, so concurrent readers must not use it.
+func (c *TCPConn) readMessage(b []byte) (int, []byte, error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+	n, metadata, err := c.readFrame(b)
+	if c.metrics != nil {
+		// A kicked connection was closed on purpose, the read didn't fail
+		if err != nil && !c.kicked.Load() {
+			c.metrics.ReadError(c.address, errorKind(err))
+		} else {
+			c.metrics.MessageRead(c.address, n)
+		}
+	}
+	return n, metadata, err
+}
+
+// readFrame must be called with the readLock held. The whole frame is read
+// from the same socket, even if Reopen replaces it part way through.
+func (c *TCPConn) readFrame(b []byte) (int, []byte, error) {
+	sock, state := c.current()
+	if state != StateConnected {
+		return 0, nil, ErrConnectionClosed
+	}
+	// Read the header. Waiting for the first byte is just an idle client, so
+	// the deadlines for the frame only start once it arrives
+	c.awaitFrame(sock)
+	hLength, err := lowLevelRead(sock, c.incomingHeaderBuffer[:1])
+	c.beginFrame(sock)
+	if err != nil {
+		return hLength, nil, err
+	}
+	deadlines := c.frameReadTimeout > 0 || c.minReadRate > 0
+	var start time.Time
+	var deadlineErr error
+	if deadlines {
+		start = time.Now()
+		deadlineErr = c.setFrameDeadline(sock, start, -1)
+		defer c.setReadDeadline(sock, time.Time{})
+	}
+	n, err := lowLevelRead(sock, c.incomingHeaderBuffer[1:])
+	hLength += n
 	if err != nil {
-		return hLength, err
+		c.close(sock)
+		return hLength, nil, frameError(err, deadlineErr)
 	}
 	// Decode it
 	msgLength, bytesParsed := byteArrayToUInt32(c.incomingHeaderBuffer)
 	if bytesParsed == 0 {
 		// "Buffer too small"
-		c.Close()
-		return hLength, ErrZeroBytesReadHeader
+		c.close(sock)
+		return hLength, nil, ErrZeroBytesReadHeader
 	} else if bytesParsed < 0 {
 		// "Buffer overflow"
-		c.Close()
-		return hLength, ErrLessThanZeroBytesReadHeader
+		c.close(sock)
+		return hLength, nil, ErrLessThanZeroBytesReadHeader
+	}
+	// Nothing from here on can be trusted if the size is out of range. The
+	// frame may be larger than the message, by the metadata and encryption
+	if msgLength < 1 || msgLength > int64(c.maxFrameSize) {
+		c.close(sock)
+		return 0, nil, &MessageSizeError{Size: msgLength, Max: c.maxFrameSize}
+	}
+	if c.minReadRate > 0 {
+		deadlineErr = c.setFrameDeadline(sock, start, msgLength)
+	}
+
+	var metadata []byte
+	if c.enableMetadata {
+		// The metadata section comes first, and counts against the frame size
+		if msgLength < metadataLengthSize {
+			c.close(sock)
+			return 0, nil, ErrInvalidMetadata
+		}
+		if _, err := lowLevelRead(sock, c.incomingMetadataBuffer[:metadataLengthSize]); err != nil {
+			c.close(sock)
+			return 0, nil, frameError(err, deadlineErr)
+		}
+		metadataLength := int64(binary.BigEndian.Uint16(c.incomingMetadataBuffer))
+		if metadataLength > int64(c.maxMetadataSize) || metadataLength > msgLength-metadataLengthSize {
+			c.close(sock)
+			return 0, nil, ErrInvalidMetadata
+		}
+		metadata = c.incomingMetadataBuffer[metadataLengthSize : metadataLengthSize+metadataLength]
+		if metadataLength > 0 {
+			if _, err := lowLevelRead(sock, metadata); err != nil {
+				c.close(sock)
+				return 0, nil, frameError(err, deadlineErr)
+			}
+		}
+		msgLength -= metadataLengthSize + metadataLength
+	}
+
+	// An encrypted payload is read aside, and decrypted into b
+	protected := c.keys != nil || c.requireEncryption || c.requireSignature
+	var p protection
+	sealed := false
+	if protected {
+		if p, err = parseProtection(metadata); err != nil {
+			c.close(sock)
+			return 0, nil, err
+		}
+		sealed = p.encryptionID != nil && c.incomingSealedBuffer != nil
+	}
+	maxLength, plainLength, dst := int64(c.maxMessageSize), msgLength, b
+	if sealed {
+		maxLength, plainLength, dst = int64(c.maxMessageSize+sealOverhead), msgLength-sealOverhead, c.incomingSealedBuffer
+	}
+	if msgLength < 1 || msgLength > maxLength {
+		c.close(sock)
+		return 0, nil, &MessageSizeError{Size: plainLength, Max: c.maxMessageSize}
+	}
+	if plainLength > int64(len(b)) {
+		c.close(sock)
+		return 0, nil, io.ErrShortBuffer
 	}
 
 	// Using the header, read the remaining body
-	bLength, err := c.lowLevelRead(b[:msgLength])
+	bLength, err := lowLevelRead(sock, dst[:msgLength])
 	if err != nil {
-		c.Close()
+		c.close(sock)
+		return bLength, metadata, frameError(err, deadlineErr)
+	}
+	if protected {
+		// The frame was read whole, so the stream is intact even if the message
+		// is rejected
+		bLength, err = c.unprotect(p, metadata, dst[:msgLength], b)
+	}
+	return bLength, metadata, err
+}
+
+// setFrameDeadline sets the read deadline for the rest of a frame that began
+// at start. The size is -1 until the header has been read. It returns the
+// error to report if the deadline passes.
+func (c *TCPConn) setFrameDeadline(sock *net.TCPConn, start time.Time, size int64) error {
+	var deadline time.Time
+	var deadlineErr error
+	if c.frameReadTimeout > 0 {
+		deadline, deadlineErr = start.Add(c.frameReadTimeout), ErrFrameTimeout
+	}
+	if c.minReadRate > 0 && size >= 0 {
+		allowed := DefaultMinReadRateGrace + time.Duration(size)*time.Second/time.Duration(c.minReadRate)
+		if d := start.Add(allowed); deadline.IsZero() || d.Before(deadline) {
+			deadline, deadlineErr = d, ErrReadTooSlow
+		}
+	}
+	if !deadline.IsZero() {
+		c.setReadDeadline(sock, deadline)
+	}
+	return deadlineErr
+}
+
+// frameError reports a read that timed out part way through a frame as the
+// deadline it missed
+func frameError(err error, deadlineErr error) error {
+	var netErr net.Error
+	if deadlineErr != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return deadlineErr
+	}
+	return err
+}
+
+func (c *TCPConn) setReadDeadline(sock *net.TCPConn, t time.Time) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	if c.interrupted {
+		t = time.Now()
+	}
+	sock.SetReadDeadline(t)
+}
+
+// interrupt fails any Read that is blocked, or started from now on, for a
+// listener that is shutting down before it has accepted the connection
+func (c *TCPConn) interrupt() {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.interrupted = true
+	c.socket.SetReadDeadline(time.Now())
+}
+
+// drainReadTimeout is how long a draining connection waits for another frame
+// to begin. Frames already buffered are read straight away, as the deadline
+// hasn't passed when the read is made.
+const drainReadTimeout = 10 * time.Millisecond
+
+// stopWhenIdle has a connection served by a listener that is shutting down
+// keep reading the frames already sent, failing the first read that would
+// block waiting for another to begin
+func (c *TCPConn) stopWhenIdle() {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.draining = true
+	if c.idle {
+		c.socket.SetReadDeadline(time.Now().Add(drainReadTimeout))
+	}
+}
+
+// awaitFrame marks the connection idle until beginFrame, while it waits for
+// the first byte of a frame
+func (c *TCPConn) awaitFrame(sock *net.TCPConn) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.idle = true
+	if c.draining {
+		sock.SetReadDeadline(time.Now().Add(drainReadTimeout))
+	}
+}
+
+// beginFrame lifts the deadline set while draining, once a frame has begun, so
+// the rest of it is read in full
+func (c *TCPConn) beginFrame(sock *net.TCPConn) {
+	c.deadlineLock.Lock()
+	defer c.deadlineLock.Unlock()
+	c.idle = false
+	if c.draining && !c.interrupted {
+		sock.SetReadDeadline(time.Time{})
 	}
-	return bLength, err
 }
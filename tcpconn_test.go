@@ -1,9 +1,16 @@
 package buffstreams
 
 import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
 	"log"
+	"net"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -62,6 +69,12 @@ var (
 )
 
 func TestMain(m *testing.M) {
+	// Fuzzing workers only run the fuzz target, and the ports below are already
+	// held by the process coordinating them
+	flag.Parse()
+	if f := flag.Lookup("test.fuzzworker"); f != nil && f.Value.String() == "true" {
+		os.Exit(m.Run())
+	}
 	btl, err := ListenTCP(listenConfig)
 	if err != nil {
 		log.Fatal(err)
@@ -94,7 +107,7 @@ func TestDialBuffTCPUsesDefaultMessageSize(t *testing.T) {
 	}
 	buffM, err := DialTCP(&cfg)
 	if err != nil {
-		t.Errorf("Failed to open connection to %d: %s", cfg.Address, err)
+		t.Errorf("Failed to open connection to %s: %s", cfg.Address, err)
 	}
 	if buffM.maxMessageSize != DefaultMaxMessageSize {
 		t.Errorf("Expected Max Message Size to be %d, actually got %d", DefaultMaxMessageSize, buffM.maxMessageSize)
@@ -108,20 +121,407 @@ func TestDialBuffTCPUsesSpecifiedMaxMessageSize(t *testing.T) {
 	}
 	conn, err := DialTCP(&cfg)
 	if err != nil {
-		t.Errorf("Failed to open connection to %d: %s", cfg.Address, err)
+		t.Errorf("Failed to open connection to %s: %s", cfg.Address, err)
 	}
 	if conn.maxMessageSize != cfg.MaxMessageSize {
 		t.Errorf("Expected Max Message Size to be %d, actually got %d", cfg.MaxMessageSize, conn.maxMessageSize)
 	}
 }
 
+func TestTCPConnHooks(t *testing.T) {
+	var dialErr, reconnectErr error
+	dialed, reconnected := false, false
+	cfg := TCPConnConfig{
+		Address:     buffWriteConfig.Address,
+		OnDial:      func(_ string, err error) { dialed, dialErr = true, err },
+		OnReconnect: func(_ string, err error) { reconnected, reconnectErr = true, err },
+	}
+	conn, err := DialTCP(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", cfg.Address, err)
+	}
+	defer conn.Close()
+	if !dialed || dialErr != nil {
+		t.Errorf("Expected OnDial to be invoked without an error, actually got %v, %v", dialed, dialErr)
+	}
+	if err := conn.Reopen(); err != nil {
+		t.Fatalf("Failed to reopen connection to %s: %s", cfg.Address, err)
+	}
+	if !reconnected || reconnectErr != nil {
+		t.Errorf("Expected OnReconnect to be invoked without an error, actually got %v, %v", reconnected, reconnectErr)
+	}
+
+	// Nothing is listening on this port
+	dialed = false
+	cfg.Address = FormatAddress("127.0.0.1", strconv.Itoa(5099))
+	if _, err := DialTCP(&cfg); err == nil {
+		t.Fatalf("Expected dialing %s to fail", cfg.Address)
+	}
+	if !dialed || dialErr == nil {
+		t.Errorf("Expected OnDial to be invoked with the dial error, actually got %v, %v", dialed, dialErr)
+	}
+}
+
+func TestTCPConnStateTransitions(t *testing.T) {
+	conn, err := DialTCP(&buffWriteConfig)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", buffWriteConfig.Address, err)
+	}
+	defer conn.Close()
+	if state := conn.State(); state != StateConnected {
+		t.Errorf("Expected a dialed connection to be connected, actually %s", state)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Expected Close to succeed, actually got %s", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Expected a second Close to do nothing, actually got %s", err)
+	}
+	if state := conn.State(); state != StateClosed {
+		t.Errorf("Expected a closed connection to be closed, actually %s", state)
+	}
+	if _, err := conn.Write([]byte("hello")); err != ErrConnectionClosed {
+		t.Errorf("Expected ErrConnectionClosed writing to a closed connection, actually got %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 16)); err != ErrConnectionClosed {
+		t.Errorf("Expected ErrConnectionClosed reading from a closed connection, actually got %v", err)
+	}
+	// Only Reopen brings back a connection that was closed on purpose
+	if err := conn.reconnect(); err != ErrConnectionClosed || conn.State() != StateClosed {
+		t.Errorf("Expected reconnect to leave a closed connection closed, actually got %v", err)
+	}
+	if err := conn.Reopen(); err != nil {
+		t.Fatalf("Failed to reopen connection to %s: %s", buffWriteConfig.Address, err)
+	}
+	if state := conn.State(); state != StateConnected {
+		t.Errorf("Expected a reopened connection to be connected, actually %s", state)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Errorf("Expected Write to succeed after Reopen, actually got %s", err)
+	}
+	// A connection broken by a failed read or write can be reconnected
+	sock, _ := conn.current()
+	conn.close(sock)
+	if err := conn.reconnect(); err != nil || conn.State() != StateConnected {
+		t.Errorf("Expected reconnect to revive a broken connection, actually got %v", err)
+	}
+}
+
+func TestTCPConnConcurrentWritesKeepFramesWhole(t *testing.T) {
+	const writers, messages = 8, 200
+	var received, corrupted atomic.Int32
+	cfg := TCPListenerConfig{
+		Address: FormatAddress("", strconv.Itoa(5066)),
+		// Each writer sends a message made of a single repeated byte, with a length
+		// of it's own, so any interleaving shows up as a mixed or misaligned message
+		Callback: func(data []byte) error {
+			if len(data) != 100+int(data[0]) || bytes.Count(data, data[:1]) != len(data) {
+				corrupted.Add(1)
+			}
+			received.Add(1)
+			return nil
+		},
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	defer l.Close()
+	l.StartListeningAsync()
+
+	conn, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5066))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer conn.Close()
+	var wg sync.WaitGroup
+	for w := 1; w <= writers; w++ {
+		wg.Add(1)
+		go func(w byte) {
+			defer wg.Done()
+			message := bytes.Repeat([]byte{w}, 100+int(w))
+			for i := 0; i < messages; i++ {
+				if _, err := conn.Write(message); err != nil {
+					t.Errorf("Expected Write to succeed, actually got %s", err)
+					return
+				}
+			}
+		}(byte(w))
+	}
+	wg.Wait()
+	waitForCount(t, &received, writers*messages)
+	if n := corrupted.Load(); n != 0 {
+		t.Errorf("Expected every frame to arrive whole, actually %d were corrupted", n)
+	}
+}
+
+func TestTCPConnConcurrentCloseAndReopen(t *testing.T) {
+	var received atomic.Int32
+	l := startCountingListener(t, 5067, &received)
+	defer l.Close()
+
+	conn, err := DialTCP(&TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5067))})
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	defer conn.Close()
+	stop := make(chan struct{})
+	var writers, reader sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Failures are expected while the socket is being swapped
+				if _, err := conn.Write([]byte("hello")); err != nil {
+					conn.reconnect()
+				}
+			}
+		}()
+	}
+	// Nothing is sent back, so reads only ever end with the socket closing
+	reader.Add(1)
+	go func() {
+		defer reader.Done()
+		buf := make([]byte, 16)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := conn.Read(buf); err != nil {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	for i := 0; i < 20; i++ {
+		if i%2 == 0 {
+			conn.Close()
+		} else {
+			conn.Reopen()
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := conn.Reopen(); err != nil {
+		t.Fatalf("Failed to reopen connection: %s", err)
+	}
+	waitForCount(t, &received, received.Load()+1)
+	close(stop)
+	writers.Wait()
+	// The reader only notices stop once it's blocked read fails
+	conn.Close()
+	reader.Wait()
+	if state := conn.State(); state != StateClosed {
+		t.Errorf("Expected the connection to end closed, actually %s", state)
+	}
+}
+
+// rawPair returns a TCPConn reading from a socket, and the raw socket that
+// writes to it, so tests can send whatever bytes they like
+func rawPair(t testing.TB, cfg *TCPConnConfig) (*TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Could not Listen: %s", err)
+	}
+	defer l.Close()
+	client, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatalf("Failed to open connection: %s", err)
+	}
+	server, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatalf("Failed to accept connection: %s", err)
+	}
+	conn, err := newTCPConn(cfg)
+	if err != nil {
+		t.Fatalf("Failed to create connection: %s", err)
+	}
+	conn.socket = server
+	conn.state = StateConnected
+	return conn, client
+}
+
+func TestReadRejectsFramesOutsideMaxMessageSize(t *testing.T) {
+	cfg := &TCPConnConfig{MaxMessageSize: 100}
+	headerSize := messageSizeToBitLength(100)
+	for _, size := range []int64{0, -5, 101, 8000} {
+		conn, client := rawPair(t, cfg)
+		client.Write(intToByteArray(size, headerSize))
+		_, err := conn.Read(make([]byte, 100))
+		var sizeErr *MessageSizeError
+		if !errors.Is(err, ErrMessageTooLarge) || !errors.As(err, &sizeErr) || sizeErr.Size != size || sizeErr.Max != 100 {
+			t.Errorf("Expected a MessageSizeError for a frame of %d bytes, actually got %v", size, err)
+		}
+		if state := conn.State(); state != StateClosed {
+			t.Errorf("Expected the connection to be closed, actually %s", state)
+		}
+		client.Close()
+	}
+
+	// With metadata, a frame has room for the headers on top of the message,
+	// and the error reports whichever limit was exceeded
+	metadataCfg := &TCPConnConfig{MaxMessageSize: 100, EnableMetadata: true, MaxHeaderSize: 20}
+	metadataHeaderSize := messageSizeToBitLength(100 + metadataLengthSize + 20)
+	for _, c := range []struct {
+		frame []byte
+		size  int64
+		max   int
+	}{
+		{intToByteArray(200, metadataHeaderSize), 200, 100 + metadataLengthSize + 20},
+		{append(intToByteArray(110, metadataHeaderSize), 0, 5, 'a', 'b', 'c', 'd', 'e'), 103, 100},
+	} {
+		conn, client := rawPair(t, metadataCfg)
+		client.Write(c.frame)
+		_, err := conn.Read(make([]byte, 100))
+		var sizeErr *MessageSizeError
+		if !errors.As(err, &sizeErr) || sizeErr.Size != c.size || sizeErr.Max != c.max {
+			t.Errorf("Expected a MessageSizeError for %d of %d bytes, actually got %v", c.size, c.max, err)
+		}
+		client.Close()
+	}
+
+	conn, client := rawPair(t, cfg)
+	defer client.Close()
+	defer conn.Close()
+	client.Write(append(intToByteArray(50, headerSize), make([]byte, 50)...))
+	if _, err := conn.Read(make([]byte, 10)); err != io.ErrShortBuffer {
+		t.Errorf("Expected io.ErrShortBuffer reading into a small buffer, actually got %v", err)
+	}
+	if _, err := btc.Write(make([]byte, 0)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Errorf("Expected writing an empty message to fail, actually got %v", err)
+	}
+}
+
+func TestReadTimesOutSlowFrames(t *testing.T) {
+	headerSize := messageSizeToBitLength(4096)
+	conn, client := rawPair(t, &TCPConnConfig{FrameReadTimeout: 50 * time.Millisecond})
+	defer client.Close()
+	// An idle client is left alone, until it starts a frame
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 4096))
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.Write(intToByteArray(100, headerSize))
+	client.Write(make([]byte, 10))
+	select {
+	case err := <-done:
+		if err != ErrFrameTimeout {
+			t.Errorf("Expected ErrFrameTimeout, actually got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the read of a trickled frame to time out")
+	}
+
+	conn, client = rawPair(t, &TCPConnConfig{MinReadRate: 1 << 20})
+	defer client.Close()
+	client.Write(intToByteArray(4000, headerSize))
+	client.Write(make([]byte, 10))
+	start := time.Now()
+	if _, err := conn.Read(make([]byte, 4096)); err != ErrReadTooSlow {
+		t.Errorf("Expected ErrReadTooSlow, actually got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < DefaultMinReadRateGrace/2 {
+		t.Errorf("Expected the frame to be given the grace period, actually failed after %s", elapsed)
+	}
+}
+
+// FuzzTCPConnRead feeds arbitrary bytes to a TCPConn, which must never panic,
+// and may only return messages within MaxMessageSize
+func FuzzTCPConnRead(f *testing.F) {
+	headerSize := messageSizeToBitLength(64)
+	f.Add(append(intToByteArray(5, headerSize), "hello"...), false)
+	f.Add(intToByteArray(-1, headerSize), false)
+	f.Add(intToByteArray(0, headerSize), false)
+	f.Add(intToByteArray(8000, headerSize), false)
+	f.Add(append(intToByteArray(30, headerSize), "truncated"...), false)
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, false)
+	f.Add(append(intToByteArray(9, headerSize), 0, 2, 'a', 'b', 'c', 'd', 'e', 'f', 'g'), true)
+	f.Add(append(intToByteArray(4, headerSize), 0xff, 0xff, 'a', 'b'), true)
+	f.Add(append(intToByteArray(2, headerSize), 0, 0), true)
+	f.Fuzz(func(t *testing.T, stream []byte, metadata bool) {
+		conn, client := rawPair(t, &TCPConnConfig{MaxMessageSize: 64, EnableMetadata: metadata, MaxHeaderSize: 16})
+		defer conn.Close()
+		client.Write(stream)
+		client.Close()
+		buf := make([]byte, 64)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if n < 1 || n > 64 {
+				t.Fatalf("Read returned a message of %d bytes", n)
+			}
+		}
+	})
+}
+
+func TestWriteDoesNotAllocate(t *testing.T) {
+	// AllocsPerRun counts every allocation in the process, so the receiving end
+	// must not allocate either - use a callback that discards the message
+	lcfg := TCPListenerConfig{
+		MaxMessageSize: 2048,
+		Address:        FormatAddress("", strconv.Itoa(5036)),
+		Callback:       func([]byte) error { return nil },
+	}
+	l, err := ListenTCP(lcfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", lcfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	cfg := TCPConnConfig{
+		MaxMessageSize: 2048,
+		Address:        FormatAddress("127.0.0.1", strconv.Itoa(5036)),
+	}
+	conn, err := DialTCP(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", cfg.Address, err)
+	}
+	defer conn.Close()
+	// Prime the connection so any lazily created internal state exists
+	if _, err := conn.Write(msgBytes); err != nil {
+		t.Fatalf("Failed to write to %s: %s", cfg.Address, err)
+	}
+	allocs := testing.AllocsPerRun(1000, func() {
+		conn.Write(msgBytes)
+	})
+	if allocs != 0 {
+		t.Errorf("Expected Write to make 0 allocations, actually got %v", allocs)
+	}
+}
+
+func TestPutHeaderClearsPreviousValue(t *testing.T) {
+	header := make([]byte, messageSizeToBitLength(DefaultMaxMessageSize))
+	putHeader(header, 4096)
+	putHeader(header, 1)
+	for i, b := range header[1:] {
+		if b != 0 {
+			t.Errorf("Expected byte %d of the header to be cleared, actually got %d", i+1, b)
+		}
+	}
+	if result, _ := byteArrayToUInt32(header); result != 1 {
+		t.Errorf("Expected header to decode to 1, actually got %d", result)
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
+	b.ReportAllocs()
 	for n := 0; n < b.N; n++ {
 		btc.Write(msgBytes)
 	}
 }
 
 func BenchmarkWrite2(b *testing.B) {
+	b.ReportAllocs()
 	for n := 0; n < b.N; n++ {
 		btc2.Write(msgBytes)
 	}
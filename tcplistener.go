@@ -1,27 +1,153 @@
 package buffstreams
 
 import (
-	"log"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
 	"net"
+	"net/netip"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// ErrConnectionNotFound represents the error where a caller has tried to reach a
+// connection ID that the TCPListener is not currently tracking.
+var ErrConnectionNotFound = errors.New("No connection with this ID is open on the listener.")
+
+// ErrListenerShutdown is the reason given to OnDisconnect for connections that
+// were drained because the TCPListener was shut down.
+var ErrListenerShutdown = errors.New("The listener has been shut down.")
+
+// ErrKicked is the reason given to OnDisconnect for connections closed by Kick.
+var ErrKicked = errors.New("The connection was kicked by the listener.")
+
 // ListenCallback is a function type that calling code will need to implement in order
 // to receive arrays of bytes from the socket. Each slice of bytes will be stripped of the
 // size header, meaning you can directly serialize the raw slice. You would then perform your
 // custom logic for interpretting the message, before returning. You can optionally
-// return an error, which in turn will be logged if EnableLogging is set to true.
+// return an error, which in turn will be logged if a Logger is configured.
 type ListenCallback func([]byte) error
 
+// ListenContextCallback is a variant of ListenCallback that also receives a context.
+// The context carries the ConnectionInfo of the client that sent the message, the
+// TraceContext propagated with it, if there was one, and whatever the configured
+// Tracer added to it.
+type ListenContextCallback func(context.Context, []byte) error
+
+// ConnectionInfo describes a single client connection accepted by a TCPListener.
+type ConnectionInfo struct {
+	// ID uniquely identifies the connection for the lifetime of the listener
+	ID uint64
+	// RemoteAddress is the ip:port of the connected client. For a client relayed
+	// by one of the TrustedProxies, it's the address the proxy reported.
+	RemoteAddress string
+	// ProxyAddress is the ip:port of the trusted proxy that relayed the client,
+	// if it was relayed
+	ProxyAddress string
+	// ConnectedAt is the time the connection was accepted
+	ConnectedAt time.Time
+	// Principal is who the client authenticated as, if the listener has an
+	// Authenticator. It is empty until the client has authenticated.
+	Principal string
+}
+
+type connectionInfoKey struct{}
+
+// ConnectionInfoFromContext returns the client connection a message was read
+// from, for the context given to a ContextCallback.
+func ConnectionInfoFromContext(ctx context.Context) (ConnectionInfo, bool) {
+	info, ok := ctx.Value(connectionInfoKey{}).(ConnectionInfo)
+	return info, ok
+}
+
+// info describes an accepted connection for the registry and lifecycle hooks
+func (c *TCPConn) info() ConnectionInfo {
+	info := ConnectionInfo{
+		ID:            c.id,
+		RemoteAddress: c.socket.RemoteAddr().String(),
+		ProxyAddress:  c.proxyAddress,
+		ConnectedAt:   c.connectedAt,
+		Principal:     c.principal,
+	}
+	if c.clientAddress.IsValid() {
+		info.RemoteAddress = c.clientAddress.String()
+	}
+	return info
+}
+
 // TCPListener represents the abstraction over a raw TCP socket for reading streaming
 // protocolbuffer data without having to write a ton of boilerplate
 type TCPListener struct {
 	socket          *net.TCPListener
-	enableLogging   bool
-	callback        ListenCallback
+	logger          *logger
+	metrics         Metrics
+	handlers        atomic.Pointer[listenerHandlers]
 	shutdownChannel chan struct{}
 	shutdownGroup   *sync.WaitGroup
-	connConfig      *TCPConnConfig
+	shutdownOnce    *sync.Once
+	// forced is set once a Shutdown runs out of time, so connections are closed
+	// without draining
+	forced atomic.Bool
+	// config and connConfig are replaced by Reload, so read them under the lock
+	config     TCPListenerConfig
+	connConfig *TCPConnConfig
+	configLock *sync.RWMutex
+
+	// Registry of the connections currently being served by a readLoop
+	connections      map[uint64]*TCPConn
+	connectionsLock  *sync.RWMutex
+	nextConnectionID atomic.Uint64
+
+	// Rate limiters shared by the connections from each remote IP
+	ipLimiters     map[string]*ipLimiter
+	ipLimitersLock *sync.Mutex
+
+	// Connections admitted and not yet closed, in total and per remote IP
+	openConnections int
+	openPerIP       map[string]int
+	admissionLock   *sync.Mutex
+}
+
+// listenerHandlers are the parts of a TCPListener's configuration that Reload
+// replaces while it is serving connections. They are loaded afresh for each
+// message and each hook, so a reload takes effect on existing connections too.
+type listenerHandlers struct {
+	callback        ListenCallback
+	contextCallback ListenContextCallback
+	headersCallback ListenHeadersCallback
+	schemaValidator SchemaValidator
+	requireSchema   bool
+	schemaCallbacks map[SchemaRef]ListenCallback
+	tracer          Tracer
+	onAccept        func(ConnectionInfo) error
+	onConnect       func(ConnectionInfo)
+	onDisconnect    func(ConnectionInfo, error)
+	onReadError     func(ConnectionInfo, error)
+	onCallbackError func(ConnectionInfo, error)
+	onDrain         func(ConnectionInfo) error
+	onReject        func(ConnectionInfo, error)
+}
+
+func newListenerHandlers(cfg TCPListenerConfig) *listenerHandlers {
+	return &listenerHandlers{
+		callback:        cfg.Callback,
+		contextCallback: cfg.ContextCallback,
+		headersCallback: cfg.HeadersCallback,
+		schemaValidator: cfg.SchemaValidator,
+		requireSchema:   cfg.RequireSchema,
+		schemaCallbacks: cfg.SchemaCallbacks,
+		tracer:          cfg.Tracer,
+		onAccept:        cfg.OnAccept,
+		onConnect:       cfg.OnConnect,
+		onDisconnect:    cfg.OnDisconnect,
+		onReadError:     cfg.OnReadError,
+		onCallbackError: cfg.OnCallbackError,
+		onDrain:         cfg.OnDrain,
+		onReject:        cfg.OnReject,
+	}
 }
 
 // TCPListenerConfig representss the information needed to begin listening for
@@ -30,8 +156,15 @@ type TCPListenerConfig struct {
 	// Controls how large the largest Message may be. The server will reject any messages whose clients
 	// header size does not match this configuration
 	MaxMessageSize int
-	// Controls the ability to enable logging errors occuring in the library
+	// Controls the ability to enable logging errors occuring in the library. If no
+	// Logger is provided, warnings and errors are written via the default slog.Logger
 	EnableLogging bool
+	// Logger optionally receives structured events from the listener and every
+	// connection it accepts. If it is nil and EnableLogging is false, nothing is logged
+	Logger slog.Handler
+	// Metrics optionally records messages, bytes, errors, callback latency and
+	// active connections for the listener, labeled with Address
+	Metrics Metrics
 	// The local address to listen for incoming connections on. Typically, you exclude
 	// the ip, and just provide port, ie: ":5031"
 	Address string
@@ -39,29 +172,145 @@ type TCPListenerConfig struct {
 	// is your responsibility to handle parsing the incoming message and handling errors
 	// inside the callback
 	Callback ListenCallback
+	// ContextCallback is used in place of Callback when it is set
+	ContextCallback ListenContextCallback
+	// HeadersCallback is used in place of Callback when it is set, and
+	// ContextCallback is not
+	HeadersCallback ListenHeadersCallback
+	// EnableMetadata expects a metadata section in every frame, used to carry headers
+	// and propagate trace context. The clients must have the same setting for this to work.
+	EnableMetadata bool
+	// MaxHeaderSize controls how large the encoded headers of a single message may
+	// be, including any trace context. It must match the clients configuration.
+	MaxHeaderSize int
+	// SchemaValidator optionally checks each message that declares a schema in
+	// it's headers, rejecting those that fail with a *SchemaError
+	SchemaValidator SchemaValidator
+	// RequireSchema rejects any message that doesn't declare a schema
+	RequireSchema bool
+	// SchemaCallbacks optionally routes messages to a callback by the schema they
+	// declare, in place of Callback. A SchemaRef with a Version of 0 matches
+	// every version of that ID not routed more specifically.
+	SchemaCallbacks map[SchemaRef]ListenCallback
+	// Tracer is optionally invoked around each Callback
+	Tracer Tracer
+	// KeyRing optionally decrypts and verifies each message read, and encrypts
+	// and signs each message sent to the clients. It requires EnableMetadata. A
+	// message that fails is treated as a read error, closing the connection.
+	KeyRing *KeyRing
+	// RequireEncryption rejects any message read that isn't encrypted
+	RequireEncryption bool
+	// RequireSignature rejects any message read that isn't signed
+	RequireSignature bool
+	// FrameReadTimeout optionally closes a connection if the rest of a frame
+	// doesn't arrive within it, once it's first byte has. Waiting for a frame to
+	// begin is never limited.
+	FrameReadTimeout time.Duration
+	// MinReadRate optionally closes a connection if a frame arrives slower than
+	// this many bytes per second, once it has begun, after allowing
+	// DefaultMinReadRateGrace for the network.
+	MinReadRate int
+	// ConnRateLimit optionally limits the messages and bytes each connection may send
+	ConnRateLimit *RateLimit
+	// IPRateLimit optionally limits the messages and bytes sent by all of the
+	// connections from a single remote IP, together
+	IPRateLimit *RateLimit
+	// RateLimitAction is what to do with a message that exceeds either limit. The
+	// default is RateLimitDelay.
+	RateLimitAction RateLimitAction
+	// MaxConnections limits how many clients may be served at once. 0 is unlimited.
+	MaxConnections int
+	// MaxConnectionsPerIP limits how many clients may be served at once from a
+	// single remote IP. 0 is unlimited.
+	MaxConnectionsPerIP int
+	// AllowCIDRs optionally restricts clients to those with an address in one of
+	// the prefixes
+	AllowCIDRs []netip.Prefix
+	// DenyCIDRs refuses clients with an address in any of the prefixes, even if
+	// they are also allowed by AllowCIDRs
+	DenyCIDRs []netip.Prefix
+	// Admit is optionally invoked for each new connection that passes the
+	// allow and deny lists. Returning an error refuses it. It runs on the
+	// goroutine accepting connections, before the client counts against the
+	// connection limits or has a goroutine started for it, so it's the cheap
+	// place to refuse a flood of clients, but it must be quick. Anything slower,
+	// such as a lookup over the network, belongs in OnAccept instead.
+	Admit func(ConnectionInfo) error
+	// Authenticator optionally authenticates each client after OnAccept, before
+	// it is tracked or any of it's messages are read. Clients that fail are
+	// refused, and the rest have their Principal set.
+	Authenticator Authenticator
+	// AuthTimeout limits how long authenticating may take. 0 uses DefaultAuthTimeout.
+	AuthTimeout time.Duration
+	// TrustedProxies optionally lists the prefixes of load balancers that relay
+	// clients with a PROXY protocol header, version 1 or 2. Connections from them
+	// must begin with one, and are treated as coming from the client it describes,
+	// for the hooks, logs, admission control and rate limits. Connections from
+	// anywhere else are taken at face value.
+	TrustedProxies []netip.Prefix
+	// ProxyHeaderTimeout limits how long a trusted proxy may take to send the
+	// header. 0 uses DefaultProxyHeaderTimeout.
+	ProxyHeaderTimeout time.Duration
+
+	// The following hooks are all optional, and are invoked from the goroutine
+	// serving the connection, so a slow hook only holds up that one client.
+
+	// OnAccept is invoked for each new connection before any data is read from
+	// it, once it has been admitted and is being served on it's own goroutine.
+	// Returning an error rejects the client, closing the connection immediately,
+	// and reporting it to OnReject.
+	OnAccept func(ConnectionInfo) error
+	// OnConnect is invoked once a connection has been accepted and is being tracked.
+	OnConnect func(ConnectionInfo)
+	// OnDisconnect is invoked once a connection has been closed, with the error
+	// that ended it. A client hanging up cleanly is reported as io.EOF.
+	OnDisconnect func(ConnectionInfo, error)
+	// OnReadError is invoked when reading from a connection fails for any reason
+	// other than the client hanging up cleanly.
+	OnReadError func(ConnectionInfo, error)
+	// OnCallbackError is invoked with any error returned from the Callback.
+	OnCallbackError func(ConnectionInfo, error)
+	// OnDrain is invoked during Shutdown for each connection, once it's current
+	// Callback has finished but before it is closed. The connection is still
+	// tracked at this point, so it's the place to flush acknowledgements via SendTo.
+	// It isn't invoked for connections closed by Close, or once the Shutdown
+	// context has expired.
+	OnDrain func(ConnectionInfo) error
+	// OnReject is invoked for each connection refused by the connection limits,
+	// the allow and deny lists, Admit, OnAccept, the Authenticator or for an
+	// invalid PROXY protocol header, with the reason. It has already been closed.
+	// Unlike the other hooks, it runs on the goroutine accepting connections,
+	// except for those OnAccept or the Authenticator refused, or that came
+	// through a trusted proxy.
+	OnReject func(ConnectionInfo, error)
 }
 
 // ListenTCP creates a TCPListener, and opens it's local connection to
 // allow it to begin receiving, once you're ready to. So the connection is open,
 // but it is not yet attempting to handle connections.
 func ListenTCP(cfg TCPListenerConfig) (*TCPListener, error) {
-	maxMessageSize := DefaultMaxMessageSize
-	// 0 is the default, and the message must be atleast 1 byte large
-	if cfg.MaxMessageSize != 0 {
-		maxMessageSize = cfg.MaxMessageSize
-	}
-	connCfg := TCPConnConfig{
-		MaxMessageSize: maxMessageSize,
-		Address:        cfg.Address,
+	connCfg, err := listenerConnConfig(cfg)
+	if err != nil {
+		return nil, err
 	}
 
 	btl := &TCPListener{
-		enableLogging:   cfg.EnableLogging,
-		callback:        cfg.Callback,
+		logger:          newLogger(cfg.Logger, cfg.EnableLogging),
+		metrics:         cfg.Metrics,
 		shutdownChannel: make(chan struct{}),
 		shutdownGroup:   &sync.WaitGroup{},
-		connConfig:      &connCfg,
+		shutdownOnce:    &sync.Once{},
+		config:          cfg,
+		connConfig:      connCfg,
+		configLock:      &sync.RWMutex{},
+		connections:     make(map[uint64]*TCPConn),
+		connectionsLock: &sync.RWMutex{},
+		ipLimiters:      make(map[string]*ipLimiter),
+		ipLimitersLock:  &sync.Mutex{},
+		openPerIP:       make(map[string]int),
+		admissionLock:   &sync.Mutex{},
 	}
+	btl.handlers.Store(newListenerHandlers(cfg))
 
 	if err := btl.openSocket(); err != nil {
 		return nil, err
@@ -70,36 +319,262 @@ func ListenTCP(cfg TCPListenerConfig) (*TCPListener, error) {
 	return btl, nil
 }
 
+// listenerConnConfig builds the configuration for the connections a listener accepts
+func listenerConnConfig(cfg TCPListenerConfig) (*TCPConnConfig, error) {
+	maxMessageSize := DefaultMaxMessageSize
+	// 0 is the default, and the message must be atleast 1 byte large
+	if cfg.MaxMessageSize != 0 {
+		maxMessageSize = cfg.MaxMessageSize
+	}
+	if cfg.EnableMetadata && cfg.MaxHeaderSize > math.MaxUint16 {
+		return nil, ErrInvalidMaxHeaderSize
+	}
+	if (cfg.KeyRing != nil || cfg.RequireEncryption || cfg.RequireSignature) && !cfg.EnableMetadata {
+		return nil, ErrMetadataDisabled
+	}
+	return &TCPConnConfig{
+		MaxMessageSize:    maxMessageSize,
+		Address:           cfg.Address,
+		EnableMetadata:    cfg.EnableMetadata,
+		MaxHeaderSize:     cfg.MaxHeaderSize,
+		KeyRing:           cfg.KeyRing,
+		RequireEncryption: cfg.RequireEncryption,
+		RequireSignature:  cfg.RequireSignature,
+		FrameReadTimeout:  cfg.FrameReadTimeout,
+		MinReadRate:       cfg.MinReadRate,
+	}, nil
+}
+
+// Reload replaces the Callbacks, schema settings, Tracer and hooks of a running
+// listener with those in cfg, in a single step. Connections already being served
+// use them from their next message. MaxMessageSize, MaxHeaderSize and
+// EnableMetadata only apply to connections accepted after the reload, as the
+// clients already connected were configured to match the old values. So do the
+// FrameReadTimeout, MinReadRate, rate limits, KeyRing and it's requirements,
+// though the keys in a KeyRing can be rotated at any time, and an IP that stays
+// connected through the reload keeps it's old IPRateLimit. Admission control and
+// the TrustedProxies apply to the next connection accepted, but never close those
+// already being served.
+// The Address, Logger, EnableLogging and Metrics of the listener are never changed.
+func (t *TCPListener) Reload(cfg TCPListenerConfig) error {
+	connCfg, err := listenerConnConfig(cfg)
+	if err != nil {
+		return err
+	}
+	t.configLock.Lock()
+	// These belong to the listener itself, so the reload can't change them
+	cfg.Address = t.config.Address
+	cfg.Logger = t.config.Logger
+	cfg.EnableLogging = t.config.EnableLogging
+	cfg.Metrics = t.config.Metrics
+	connCfg.Address = t.connConfig.Address
+	t.config = cfg
+	t.connConfig = connCfg
+	t.handlers.Store(newListenerHandlers(cfg))
+	t.configLock.Unlock()
+	return nil
+}
+
+// Config returns the configuration the listener is currently running with, as
+// a starting point for Reload.
+func (t *TCPListener) Config() TCPListenerConfig {
+	t.configLock.RLock()
+	defer t.configLock.RUnlock()
+	return t.config
+}
+
+func (t *TCPListener) currentConnConfig() *TCPConnConfig {
+	t.configLock.RLock()
+	defer t.configLock.RUnlock()
+	return t.connConfig
+}
+
 // Actually blocks the thread it's running on, and begins handling incoming
 // requests
 func (t *TCPListener) blockListen() error {
 	for {
 		// Wait for someone to connect
 		c, err := t.socket.AcceptTCP()
-		conn, err := newTCPConn(t.connConfig)
-		if err != nil {
-			return err
-		}
-		// Don't dial out, wrap the underlying conn in one of ours
-		conn.socket = c
 		if err != nil {
-			if t.enableLogging {
-				log.Printf("Error attempting to accept connection: %s", err)
-			}
 			// Stole this approach from http://zhen.org/blog/graceful-shutdown-of-go-net-dot-listeners/
 			// Benefits of a channel for the simplicity of use, but don't have to even check it
-			// unless theres an error, so performance impact to incoming conns should be lower
+			// unless theres an error, so performance impact to incoming conns should be lower.
+			// Shutdown closes the socket, which is what breaks us out of AcceptTCP
 			select {
 			case <-t.shutdownChannel:
 				return nil
 			default:
 				// Nothing, continue to the top of the loop
 			}
+			t.logger.log(slog.LevelError, "accept failed",
+				slog.String("address", t.currentConnConfig().Address), errAttrs(err))
 		} else {
-			// Hand this off and immediately listen for more
-			go t.readLoop(conn)
+			conn, err := newTCPConn(t.currentConnConfig())
+			if err != nil {
+				return err
+			}
+			// Don't dial out, wrap the underlying conn in one of ours
+			conn.socket = c
+			conn.state = StateConnected
+			conn.logger = t.logger
+			conn.id = t.nextConnectionID.Add(1)
+			conn.connectedAt = time.Now()
+			// A trusted proxy sends the client's address ahead of it's messages,
+			// which is needed before the connection can be admitted
+			if cfg := t.Config(); trustedProxy(conn, cfg.TrustedProxies) {
+				go t.acceptProxied(conn, cfg.ProxyHeaderTimeout)
+				continue
+			}
+			t.accept(conn)
+		}
+	}
+}
+
+// accept admits a newly accepted connection, and hands it off to it's own
+// goroutine to be served
+func (t *TCPListener) accept(conn *TCPConn) {
+	// Refused connections never count as opened
+	if err := t.admitConnection(conn); err != nil {
+		t.reject(conn, err)
+		return
+	}
+	if !t.admit() {
+		// We're shutting down, and this one slipped in before the socket closed
+		t.releaseConnection(conn)
+		conn.Close()
+		return
+	}
+	// Only connections that will be served count as opened, so every one is
+	// matched by a close
+	conn.metrics = t.metrics
+	if t.metrics != nil {
+		t.metrics.ConnectionOpened(conn.address)
+	}
+	go t.readLoop(conn)
+}
+
+// admit counts the connection against the shutdownGroup, unless a shutdown has
+// already begun. Checking and adding under the registry lock means Shutdown can
+// never be waiting on the group while it's being added to
+func (t *TCPListener) admit() bool {
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+	select {
+	case <-t.shutdownChannel:
+		return false
+	default:
+	}
+	t.shutdownGroup.Add(1)
+	return true
+}
+
+// interruptOnShutdown interrupts reads from a connection that isn't tracked
+// yet, if a Shutdown begins before the returned stop func is called. Tracked
+// connections are interrupted by Shutdown itself.
+func (t *TCPListener) interruptOnShutdown(conn *TCPConn) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-t.shutdownChannel:
+			conn.interrupt()
+		case <-done:
 		}
+	}()
+	return func() { close(done) }
+}
+
+// register begins tracking the connection
+func (t *TCPListener) register(conn *TCPConn) {
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+	t.connections[conn.id] = conn
+}
+
+// unregister stops tracking the connection, once it's readLoop has exited
+func (t *TCPListener) unregister(conn *TCPConn) {
+	t.connectionsLock.Lock()
+	defer t.connectionsLock.Unlock()
+	delete(t.connections, conn.id)
+}
+
+// Connections returns a description of every client connection the listener
+// is currently serving.
+func (t *TCPListener) Connections() []ConnectionInfo {
+	t.connectionsLock.RLock()
+	defer t.connectionsLock.RUnlock()
+	infos := make([]ConnectionInfo, 0, len(t.connections))
+	for _, conn := range t.connections {
+		infos = append(infos, conn.info())
+	}
+	return infos
+}
+
+// Snapshot returns the measurements recorded for this listener and the
+// connections it has accepted. It is empty unless the configured Metrics
+// implement MetricsSnapshotter, as InMemoryMetrics does.
+func (t *TCPListener) Snapshot() MetricsSnapshot {
+	return snapshotOf(t.metrics, t.currentConnConfig().Address)
+}
+
+// Broadcast writes data as a message to every connected client. Writes happen
+// concurrently, so one slow client doesn't hold up the rest. Any connection that
+// fails the write is closed, and it's error is returned keyed by connection ID.
+// If every write succeeded, the returned map is nil.
+func (t *TCPListener) Broadcast(data []byte) map[uint64]error {
+	t.connectionsLock.RLock()
+	conns := make([]*TCPConn, 0, len(t.connections))
+	for _, conn := range t.connections {
+		conns = append(conns, conn)
+	}
+	t.connectionsLock.RUnlock()
+
+	var errs map[uint64]error
+	errLock := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(c *TCPConn) {
+			defer wg.Done()
+			if _, err := c.Write(data); err != nil {
+				errLock.Lock()
+				if errs == nil {
+					errs = make(map[uint64]error)
+				}
+				errs[c.id] = err
+				errLock.Unlock()
+			}
+		}(conn)
+	}
+	wg.Wait()
+	return errs
+}
+
+// SendTo writes data as a message to a single connected client. It returns
+// ErrConnectionNotFound if the connection is not open on this listener.
+func (t *TCPListener) SendTo(connID uint64, data []byte) (int, error) {
+	t.connectionsLock.RLock()
+	conn, ok := t.connections[connID]
+	t.connectionsLock.RUnlock()
+	if !ok {
+		return 0, ErrConnectionNotFound
 	}
+	return conn.Write(data)
+}
+
+// Kick forcibly disconnects a single client, which is reported to OnDisconnect
+// as ErrKicked. It returns ErrConnectionNotFound if the connection is not open
+// on this listener.
+func (t *TCPListener) Kick(connID uint64) error {
+	t.connectionsLock.RLock()
+	conn, ok := t.connections[connID]
+	t.connectionsLock.RUnlock()
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	// The readLoop will fail it's next read, and clean up the registry itself,
+	// reporting the kick rather than the failed read
+	conn.kicked.Store(true)
+	return conn.Close()
 }
 
 // This is only ever called from either StartListening or StartListeningAsync
@@ -126,12 +601,63 @@ func (t *TCPListener) StartListening() error {
 }
 
 // Close represents a way to signal to the Listener that it should no longer accept
-// incoming connections, and begin to shutdown.
+// incoming connections, and immediately close every connection it is serving. It
+// blocks until any Callbacks in progress have returned. Use Shutdown to give
+// connections a chance to drain first.
 func (t *TCPListener) Close() {
-	close(t.shutdownChannel)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	t.Shutdown(ctx)
 	t.shutdownGroup.Wait()
 }
 
+// Shutdown gracefully stops the listener. It closes the listening socket so no
+// new connections are accepted and the port is released, then lets each connection
+// handle the messages it has already been sent, invoke OnDrain, and disconnect.
+// If the context expires before every connection has drained, the remaining
+// connections are closed immediately and the context's error is returned.
+func (t *TCPListener) Shutdown(ctx context.Context) error {
+	// Close gives no time at all, so nothing is drained
+	if ctx.Err() != nil {
+		t.forced.Store(true)
+	}
+	t.shutdownOnce.Do(func() {
+		t.connectionsLock.Lock()
+		close(t.shutdownChannel)
+		t.connectionsLock.Unlock()
+		t.socket.Close()
+	})
+
+	// Wake up any connection that is idle, waiting on it's next message. Those
+	// that are busy in a Callback, or part way through a frame, carry on serving
+	// the messages already sent until they would wait for another
+	t.connectionsLock.RLock()
+	for _, conn := range t.connections {
+		conn.stopWhenIdle()
+	}
+	t.connectionsLock.RUnlock()
+
+	drained := make(chan struct{})
+	go func() {
+		t.shutdownGroup.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		// Out of time, cut off the stragglers
+		t.forced.Store(true)
+		t.connectionsLock.RLock()
+		for _, conn := range t.connections {
+			conn.Close()
+		}
+		t.connectionsLock.RUnlock()
+		return ctx.Err()
+	}
+}
+
 // StartListeningAsync represents a way to start accepting TCP connections, which are
 // handled by the Callback provided upon initialization. It does the listening
 // in a go-routine, so as not to block.
@@ -146,41 +672,256 @@ func (t *TCPListener) StartListeningAsync() error {
 // Handles each incoming connection, run within it's own goroutine. This method will
 // loop until the client disconnects or another error occurs and is not handled
 func (t *TCPListener) readLoop(conn *TCPConn) {
-	// Increment the waitGroup in the event of a shutdown
-	t.shutdownGroup.Add(1)
+	// blockListen has already added us to the waitGroup, in the event of a shutdown
 	defer t.shutdownGroup.Done()
+	defer t.releaseConnection(conn)
+
+	if onAccept := t.handlers.Load().onAccept; onAccept != nil {
+		if err := onAccept(conn.info()); err != nil {
+			t.reject(conn, err)
+			return
+		}
+	}
+	// Limits are fixed for the life of the connection, as with it's message size
+	cfg := t.Config()
+	if cfg.Authenticator != nil {
+		if err := t.authenticate(conn, cfg.Authenticator, cfg.AuthTimeout); err != nil {
+			t.logger.log(slog.LevelInfo, "authentication failed", connAttrs(conn.info()), errAttrs(err))
+			conn.Close()
+			if t.metrics != nil {
+				t.metrics.ConnectionRejected(conn.address, "unauthenticated")
+			}
+			if onReject := t.handlers.Load().onReject; onReject != nil {
+				onReject(conn.info(), err)
+			}
+			return
+		}
+	}
+	t.register(conn)
+	t.logger.log(slog.LevelInfo, "connection accepted", connAttrs(conn.info()))
+	// If a shutdown began while we were being accepted, it may have missed us
+	// when waking up the idle connections
+	select {
+	case <-t.shutdownChannel:
+		conn.stopWhenIdle()
+	default:
+	}
+	if onConnect := t.handlers.Load().onConnect; onConnect != nil {
+		onConnect(conn.info())
+	}
+	connLimiter := newRateLimiter(cfg.ConnRateLimit)
+	ip := conn.remoteIP()
+	ipLimiter := t.acquireIPLimiter(ip, cfg.IPRateLimit)
+	if ipLimiter != nil {
+		defer t.releaseIPLimiter(ip)
+	}
+	limited := connLimiter != nil || ipLimiter != nil
+	// The reason for the disconnect is whatever error broke us out of the loop
+	var disconnectErr error
+	defer func() {
+		t.unregister(conn)
+		if t.logger.enabled(slog.LevelInfo) {
+			attrs := []slog.Attr{connAttrs(conn.info())}
+			if disconnectErr != nil {
+				attrs = append(attrs, errAttrs(disconnectErr))
+			}
+			t.logger.log(slog.LevelInfo, "connection closed", attrs...)
+		}
+		if onDisconnect := t.handlers.Load().onDisconnect; onDisconnect != nil {
+			onDisconnect(conn.info(), disconnectErr)
+		}
+	}()
+
 	// dataBuffer will hold the message from each read
 	dataBuffer := make([]byte, conn.maxMessageSize)
 
-	// Start an asyncrhonous call that will wait on the shutdown channel, and then close
-	// the connection. This will let us respond to the shutdown but also not incur
-	// a cost for checking the channel on each run of the loop
-	go func(c *TCPConn, s <-chan struct{}) {
-		<-s
-		c.Close()
-	}(conn, t.shutdownChannel)
-
 	// Begin the read loop
 	// If there is any error, close the connection officially and break out of the listen-loop.
 	// We don't store these connections anywhere else, and if we can't recover from an error on the socket
 	// we want to kill the connection, exit the goroutine, and let the client handle re-connecting if need be.
 	// Handle getting the data header
 	for {
-		msgLen, err := conn.Read(dataBuffer)
+		msgLen, metadata, err := conn.readMessage(dataBuffer)
 		if err != nil {
-			if t.enableLogging {
-				log.Printf("Address %s: Failure to read from connection. Underlying error: %s", conn.address, err)
+			// Shutdown interrupts the read with a deadline, rather than incurring
+			// a cost for checking the channel on each run of the loop
+			select {
+			case <-t.shutdownChannel:
+				if t.forced.Load() {
+					conn.Close()
+				} else {
+					t.drain(conn)
+				}
+				disconnectErr = ErrListenerShutdown
+				return
+			default:
+			}
+			if conn.kicked.Load() {
+				disconnectErr = ErrKicked
+				return
 			}
+			if err != io.EOF {
+				t.logger.log(slog.LevelWarn, "read failed", connAttrs(conn.info()), errAttrs(err))
+			}
+			if onReadError := t.handlers.Load().onReadError; onReadError != nil && err != io.EOF {
+				onReadError(conn.info(), err)
+			}
+			disconnectErr = err
 			conn.Close()
 			return
 		}
+		if t.logger.enabled(slog.LevelDebug) {
+			t.logger.log(slog.LevelDebug, "frame received", connAttrs(conn.info()), slog.Int("frame_size", msgLen))
+		}
+		if limited {
+			allowed, err := t.throttle(conn, cfg.RateLimitAction, msgLen, connLimiter, ipLimiter)
+			if err != nil {
+				t.logger.log(slog.LevelWarn, "rate limit exceeded", connAttrs(conn.info()), errAttrs(err))
+				disconnectErr = err
+				conn.Close()
+				return
+			}
+			if !allowed {
+				continue
+			}
+		}
 		// We take action on the actual message data - but only up to the amount of bytes read,
 		// since we re-use the cache
-		if err = t.callback(dataBuffer[:msgLen]); err != nil && t.enableLogging {
-			log.Printf("Error in Callback: %s", err.Error())
+		if t.metrics != nil {
+			start := time.Now()
+			err = t.invoke(conn, dataBuffer[:msgLen], metadata)
+			t.metrics.CallbackDuration(conn.address, time.Since(start))
+		} else {
+			err = t.invoke(conn, dataBuffer[:msgLen], metadata)
+		}
+		if err != nil {
+			t.logger.log(slog.LevelWarn, "callback failed", connAttrs(conn.info()), errAttrs(err))
+			if onCallbackError := t.handlers.Load().onCallbackError; onCallbackError != nil {
+				onCallbackError(conn.info(), err)
+			}
 			// TODO if it's a protobuffs error, it means we likely had an issue and can't
 			// deserialize data? Should we kill the connection and have the client start over?
 			// At this point, there isn't a reliable recovery mechanic for the server
 		}
 	}
 }
+
+// throttle applies the rate limits to a message of size bytes, reporting whether
+// it should be passed on to the Callback. It returns ErrRateLimited if the
+// connection should be closed.
+func (t *TCPListener) throttle(conn *TCPConn, action RateLimitAction, size int, limiters ...*rateLimiter) (bool, error) {
+	if action == RateLimitDelay {
+		wait := reserveMessage(size, limiters...)
+		if wait <= 0 {
+			return true, nil
+		}
+		t.recordThrottle(conn, action)
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		// A shutdown stops the wait, so the message can be handled while draining
+		select {
+		case <-timer.C:
+		case <-t.shutdownChannel:
+		}
+		return true, nil
+	}
+	if allowMessage(size, limiters...) {
+		return true, nil
+	}
+	t.recordThrottle(conn, action)
+	if action == RateLimitDisconnect {
+		return false, ErrRateLimited
+	}
+	return false, nil
+}
+
+func (t *TCPListener) recordThrottle(conn *TCPConn, action RateLimitAction) {
+	if t.metrics != nil {
+		t.metrics.Throttled(conn.address, action.String())
+	}
+	if t.logger.enabled(slog.LevelDebug) {
+		t.logger.log(slog.LevelDebug, "message throttled", connAttrs(conn.info()), slog.String("action", action.String()))
+	}
+}
+
+// invoke runs the callback for a single message. The headers and context are
+// only built when something will use them, so the plain Callback pays nothing
+// for metadata it ignores
+func (t *TCPListener) invoke(conn *TCPConn, data []byte, metadata []byte) error {
+	h := t.handlers.Load()
+	if h.contextCallback == nil && h.headersCallback == nil && h.tracer == nil &&
+		h.schemaValidator == nil && !h.requireSchema && h.schemaCallbacks == nil {
+		return h.callback(data)
+	}
+	headers, err := parseHeaders(metadata)
+	if err != nil {
+		return err
+	}
+	routed, err := h.checkSchema(headers, data)
+	if err != nil {
+		return err
+	}
+	info := conn.info()
+	ctx := context.WithValue(context.Background(), connectionInfoKey{}, info)
+	if conn.principal != "" {
+		ctx = context.WithValue(ctx, principalKey{}, conn.principal)
+	}
+	if headers != nil {
+		ctx = ContextWithHeaders(ctx, headers)
+		if v, ok := headers[traceparentKey]; ok {
+			if tc, err := ParseTraceparent(v); err == nil {
+				ctx = ContextWithTrace(ctx, tc)
+			}
+		}
+	}
+	var finish func(error)
+	if h.tracer != nil {
+		ctx, finish = h.tracer.StartCallback(ctx, info, len(data))
+	}
+	switch {
+	case routed != nil:
+		err = routed(data)
+	case h.contextCallback != nil:
+		err = h.contextCallback(ctx, data)
+	case h.headersCallback != nil:
+		err = h.headersCallback(headers, data)
+	default:
+		err = h.callback(data)
+	}
+	if finish != nil {
+		finish(err)
+	}
+	return err
+}
+
+// checkSchema validates the message against the schema it declares, and returns
+// the callback it is routed to, if any
+func (h *listenerHandlers) checkSchema(headers Headers, data []byte) (ListenCallback, error) {
+	ref, ok := headers.Schema()
+	if !ok {
+		if h.requireSchema {
+			return nil, &SchemaError{Err: ErrMissingSchema}
+		}
+		return nil, nil
+	}
+	if h.schemaValidator != nil {
+		if err := h.schemaValidator.Validate(ref, data); err != nil {
+			return nil, &SchemaError{Ref: ref, Err: err}
+		}
+	}
+	if callback, ok := h.schemaCallbacks[ref]; ok {
+		return callback, nil
+	}
+	return h.schemaCallbacks[SchemaRef{ID: ref.ID}], nil
+}
+
+// drain gives the OnDrain hook a last chance to write to the connection before
+// it is closed as part of a Shutdown
+func (t *TCPListener) drain(conn *TCPConn) {
+	if onDrain := t.handlers.Load().onDrain; onDrain != nil {
+		if err := onDrain(conn.info()); err != nil {
+			t.logger.log(slog.LevelWarn, "drain failed", connAttrs(conn.info()), errAttrs(err))
+		}
+	}
+	conn.Close()
+}
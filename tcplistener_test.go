@@ -1,8 +1,13 @@
 package buffstreams
 
 import (
+	"context"
+	"errors"
+	"io"
 	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestListenTCPUsesDefaultMessageSize(t *testing.T) {
@@ -33,3 +38,426 @@ func TestListenTCPUsesSpecifiedMaxMessageSize(t *testing.T) {
 		t.Errorf("Expected Max Message Size to be %d, actually got %d", cfg.MaxMessageSize, buffM.connConfig.MaxMessageSize)
 	}
 }
+
+// waitForConnections polls the listener until it is tracking count connections
+func waitForConnections(t *testing.T, l *TCPListener, count int) []ConnectionInfo {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if infos := l.Connections(); len(infos) == count {
+			return infos
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Expected listener to track %d connections, actually got %d", count, len(l.Connections()))
+	return nil
+}
+
+func TestListenerRegistryBroadcastSendToAndKick(t *testing.T) {
+	disconnected := make(chan error, 2)
+	readErrors := make(chan error, 2)
+	cfg := TCPListenerConfig{
+		Address:      FormatAddress("", strconv.Itoa(5037)),
+		Callback:     func([]byte) error { return nil },
+		OnDisconnect: func(_ ConnectionInfo, err error) { disconnected <- err },
+		OnReadError:  func(_ ConnectionInfo, err error) { readErrors <- err },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5037))}
+	c1, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c1.Close()
+	c2, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c2.Close()
+
+	infos := waitForConnections(t, l, 2)
+	for _, info := range infos {
+		if info.ID == 0 || info.RemoteAddress == "" || info.ConnectedAt.IsZero() {
+			t.Errorf("Expected connection info to be populated, actually got %+v", info)
+		}
+	}
+
+	if errs := l.Broadcast([]byte("hello")); errs != nil {
+		t.Errorf("Expected Broadcast to succeed, actually got %v", errs)
+	}
+	buf := make([]byte, DefaultMaxMessageSize)
+	for _, c := range []*TCPConn{c1, c2} {
+		n, err := c.Read(buf)
+		if err != nil || string(buf[:n]) != "hello" {
+			t.Errorf("Expected to read broadcast message, actually got %q: %v", buf[:n], err)
+		}
+	}
+
+	// Identify which registry entry belongs to c1 by it's local address
+	var c1ID uint64
+	for _, info := range infos {
+		if info.RemoteAddress == c1.socket.LocalAddr().String() {
+			c1ID = info.ID
+		}
+	}
+	if _, err := l.SendTo(c1ID, []byte("just you")); err != nil {
+		t.Errorf("Expected SendTo to succeed, actually got %s", err)
+	}
+	n, err := c1.Read(buf)
+	if err != nil || string(buf[:n]) != "just you" {
+		t.Errorf("Expected to read targeted message, actually got %q: %v", buf[:n], err)
+	}
+
+	if err := l.Kick(c1ID); err != nil {
+		t.Errorf("Expected Kick to succeed, actually got %s", err)
+	}
+	waitForConnections(t, l, 1)
+	select {
+	case err := <-disconnected:
+		if err != ErrKicked {
+			t.Errorf("Expected OnDisconnect to receive ErrKicked, actually got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnDisconnect to be invoked")
+	}
+	if len(readErrors) != 0 {
+		t.Errorf("Expected the kick not to be reported as a read error, actually got %v", <-readErrors)
+	}
+	if _, err := l.SendTo(c1ID, []byte("gone")); err != ErrConnectionNotFound {
+		t.Errorf("Expected ErrConnectionNotFound, actually got %v", err)
+	}
+	if err := l.Kick(c1ID); err != ErrConnectionNotFound {
+		t.Errorf("Expected ErrConnectionNotFound, actually got %v", err)
+	}
+}
+
+func TestListenerLifecycleHooks(t *testing.T) {
+	var accepts atomic.Int32
+	connected := make(chan ConnectionInfo, 2)
+	disconnected := make(chan error, 2)
+	callbackErrors := make(chan error, 1)
+	rejections := make(chan error, 1)
+	metrics := NewInMemoryMetrics()
+	cfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(5038)),
+		Metrics:  metrics,
+		OnReject: func(_ ConnectionInfo, err error) { rejections <- err },
+		Callback: func([]byte) error { return errors.New("bad message") },
+		OnAccept: func(ConnectionInfo) error {
+			if accepts.Add(1) == 1 {
+				return errors.New("rejected")
+			}
+			return nil
+		},
+		OnConnect:       func(info ConnectionInfo) { connected <- info },
+		OnDisconnect:    func(_ ConnectionInfo, err error) { disconnected <- err },
+		OnCallbackError: func(_ ConnectionInfo, err error) { callbackErrors <- err },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5038))}
+
+	// The first connection is rejected, and closed before it is ever tracked
+	rejected, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	if _, err := rejected.Read(make([]byte, DefaultMaxMessageSize)); err != io.EOF {
+		t.Errorf("Expected rejected connection to be closed with io.EOF, actually got %v", err)
+	}
+	rejected.Close()
+	select {
+	case err := <-rejections:
+		if err.Error() != "rejected" {
+			t.Errorf("Expected OnReject to receive the OnAccept error, actually got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnReject to be invoked")
+	}
+	if s := l.Snapshot(); s.Rejected["admission"] != 1 {
+		t.Errorf("Expected the rejection to be counted, actually got %v", s.Rejected)
+	}
+
+	accepted, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	select {
+	case info := <-connected:
+		if info.ID == 0 {
+			t.Errorf("Expected OnConnect to receive a connection ID")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnConnect to be invoked")
+	}
+	if _, err := accepted.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+	select {
+	case err := <-callbackErrors:
+		if err.Error() != "bad message" {
+			t.Errorf("Expected OnCallbackError to receive the callback error, actually got %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnCallbackError to be invoked")
+	}
+	accepted.Close()
+	select {
+	case err := <-disconnected:
+		if err != io.EOF {
+			t.Errorf("Expected OnDisconnect to receive io.EOF, actually got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnDisconnect to be invoked")
+	}
+	if len(connected) != 0 || len(disconnected) != 0 {
+		t.Errorf("Expected the rejected connection to never reach OnConnect or OnDisconnect")
+	}
+}
+
+func TestListenerShutdownDrainsInFlightCallbacks(t *testing.T) {
+	inCallback := make(chan struct{})
+	release := make(chan struct{})
+	var finished atomic.Bool
+	var l *TCPListener
+	cfg := TCPListenerConfig{
+		Address: FormatAddress("", strconv.Itoa(5039)),
+		Callback: func([]byte) error {
+			close(inCallback)
+			<-release
+			finished.Store(true)
+			return nil
+		},
+		OnDrain: func(info ConnectionInfo) error {
+			_, err := l.SendTo(info.ID, []byte("ack"))
+			return err
+		},
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5039))}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+	<-inCallback
+
+	shutdownErr := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- l.Shutdown(ctx)
+	}()
+	// Shutdown must wait on the callback in progress
+	select {
+	case err := <-shutdownErr:
+		t.Fatalf("Expected Shutdown to wait for the callback, actually returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Expected Shutdown to drain cleanly, actually got %s", err)
+	}
+	if !finished.Load() {
+		t.Errorf("Expected the in flight callback to finish")
+	}
+
+	buf := make([]byte, DefaultMaxMessageSize)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "ack" {
+		t.Errorf("Expected to read the acknowledgement flushed by OnDrain, actually got %q: %v", buf[:n], err)
+	}
+
+	// The port must have been released
+	cfg.OnDrain = nil
+	l2, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Expected to Listen on %s again after Shutdown, actually got %s", cfg.Address, err)
+	}
+	l2.Close()
+}
+
+func TestListenerShutdownDeliversBufferedMessages(t *testing.T) {
+	inCallback := make(chan struct{}, 3)
+	release := make(chan struct{})
+	var received atomic.Int32
+	cfg := TCPListenerConfig{
+		Address: FormatAddress("", strconv.Itoa(5086)),
+		Callback: func([]byte) error {
+			inCallback <- struct{}{}
+			<-release
+			received.Add(1)
+			return nil
+		},
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5086))}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		if _, err := c.Write([]byte("hello")); err != nil {
+			t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+		}
+	}
+	<-inCallback
+
+	// The other two messages are waiting in the socket while the first is handled
+	shutdownErr := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- l.Shutdown(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("Expected Shutdown to drain cleanly, actually got %s", err)
+	}
+	if n := received.Load(); n != 3 {
+		t.Errorf("Expected all 3 messages already sent to be handled, actually got %d", n)
+	}
+}
+
+func TestListenerCloseSkipsDrain(t *testing.T) {
+	var drained atomic.Bool
+	cfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(5087)),
+		Callback: func([]byte) error { return nil },
+		OnDrain: func(ConnectionInfo) error {
+			drained.Store(true)
+			return nil
+		},
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5087))}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+	waitForConnections(t, l, 1)
+
+	l.Close()
+	if drained.Load() {
+		t.Errorf("Expected Close to skip OnDrain")
+	}
+}
+
+func TestListenerShutdownForceClosesAfterDeadline(t *testing.T) {
+	inCallback := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	cfg := TCPListenerConfig{
+		Address: FormatAddress("", strconv.Itoa(5040)),
+		Callback: func([]byte) error {
+			close(inCallback)
+			<-release
+			return nil
+		},
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5040))}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+	<-inCallback
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to give up with context.DeadlineExceeded, actually got %v", err)
+	}
+	// The straggler was force closed
+	if _, err := c.Read(make([]byte, DefaultMaxMessageSize)); err != io.EOF {
+		t.Errorf("Expected the connection to be closed with io.EOF, actually got %v", err)
+	}
+}
+
+func TestListenerReloadSwapsCallbackAndLimits(t *testing.T) {
+	received := make(chan string, 4)
+	cfg := TCPListenerConfig{
+		Address:  FormatAddress("", strconv.Itoa(5061)),
+		Callback: func(data []byte) error { received <- "old"; return nil },
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+
+	connCfg := TCPConnConfig{Address: FormatAddress("127.0.0.1", strconv.Itoa(5061))}
+	c1, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c1.Close()
+	c1.Write([]byte("hi"))
+	if got := <-received; got != "old" {
+		t.Fatalf("Expected the original callback, actually got %s", got)
+	}
+
+	reloaded := l.Config()
+	reloaded.MaxMessageSize = 65536
+	reloaded.Callback = func(data []byte) error { received <- "new:" + strconv.Itoa(len(data)); return nil }
+	if err := l.Reload(reloaded); err != nil {
+		t.Fatalf("Expected Reload to succeed, actually got %s", err)
+	}
+
+	// The existing connection keeps it's framing, but uses the new callback
+	c1.Write([]byte("hi"))
+	if got := <-received; got != "new:2" {
+		t.Errorf("Expected the new callback on the existing connection, actually got %s", got)
+	}
+	// New connections get the new limits
+	bigCfg := TCPConnConfig{Address: connCfg.Address, MaxMessageSize: 65536}
+	c2, err := DialTCP(&bigCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c2.Close()
+	c2.Write(make([]byte, 10000))
+	if got := <-received; got != "new:10000" {
+		t.Errorf("Expected a message over the old limit to be accepted, actually got %s", got)
+	}
+	if l.Config().Address != cfg.Address {
+		t.Errorf("Expected Reload to keep the Address, actually got %s", l.Config().Address)
+	}
+}
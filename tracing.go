@@ -0,0 +1,93 @@
+package buffstreams
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+)
+
+// ErrInvalidTraceparent is returned when a traceparent value does not follow
+// the W3C Trace Context format.
+var ErrInvalidTraceparent = errors.New("Invalid traceparent.")
+
+// traceparentKey is the metadata field the TraceContext is propagated in
+const traceparentKey = "traceparent"
+
+// TraceContext identifies a span, and is propagated between buffstreams hops in
+// the frame metadata using the W3C Trace Context traceparent format.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// IsValid reports whether the trace and span IDs are set. The W3C format treats
+// all zero IDs as invalid.
+func (tc TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// String formats the TraceContext as a traceparent value, ie:
+// 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func (tc TraceContext) String() string {
+	dst := make([]byte, 0, 55)
+	dst = append(dst, "00-"...)
+	dst = hex.AppendEncode(dst, tc.TraceID[:])
+	dst = append(dst, '-')
+	dst = hex.AppendEncode(dst, tc.SpanID[:])
+	dst = append(dst, '-')
+	return string(hex.AppendEncode(dst, []byte{tc.Flags}))
+}
+
+// ParseTraceparent parses a W3C Trace Context traceparent value.
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+	b := []byte(s)
+	// version-traceid-spanid-flags, only version 00 is defined
+	if len(b) != 55 || string(b[:3]) != "00-" || b[35] != '-' || b[52] != '-' {
+		return tc, ErrInvalidTraceparent
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(tc.TraceID[:], b[3:35]); err != nil {
+		return tc, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(tc.SpanID[:], b[36:52]); err != nil {
+		return tc, ErrInvalidTraceparent
+	}
+	if _, err := hex.Decode(flags[:], b[53:55]); err != nil {
+		return tc, ErrInvalidTraceparent
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return tc, ErrInvalidTraceparent
+	}
+	return tc, nil
+}
+
+type traceContextKey struct{}
+
+// ContextWithTrace returns a copy of ctx carrying tc. Tracers use it to make
+// the span they start the one propagated with a message.
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+// TraceFromContext returns the TraceContext carried by ctx, if there is one.
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok && tc.IsValid()
+}
+
+// Tracer is invoked around each traced Write, and around each Callback a
+// TCPListener runs. It is the bridge to whichever tracing library is in use.
+type Tracer interface {
+	// StartWrite is invoked before a message is written by Write or WriteContext. The
+	// TraceContext carried by the returned context, if any, is propagated with
+	// the message. The returned function is invoked with the outcome of the write.
+	StartWrite(ctx context.Context, address string, size int) (context.Context, func(error))
+	// StartCallback is invoked before a TCPListener runs it's Callback, with a
+	// context carrying the TraceContext propagated with the message, if any. The
+	// returned context is passed to a ContextCallback, and the returned function
+	// is invoked with the Callbacks error.
+	StartCallback(ctx context.Context, conn ConnectionInfo, size int) (context.Context, func(error))
+}
@@ -0,0 +1,129 @@
+package buffstreams
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	s := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, err := ParseTraceparent(s)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %s", s, err)
+	}
+	if tc.Flags != 1 || tc.SpanID[7] != 0xb7 {
+		t.Errorf("Traceparent parsed incorrectly, got %+v", tc)
+	}
+	if tc.String() != s {
+		t.Errorf("Expected traceparent %s, actually got %s", s, tc.String())
+	}
+
+	invalid := []string{
+		"",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-",
+	}
+	for _, s := range invalid {
+		if _, err := ParseTraceparent(s); err != ErrInvalidTraceparent {
+			t.Errorf("Expected %q to be invalid, actually got %v", s, err)
+		}
+	}
+}
+
+// recordingTracer starts a child span for each write and callback, by bumping
+// the last byte of the span ID
+type recordingTracer struct {
+	sync.Mutex
+	writes    []TraceContext
+	callbacks []TraceContext
+}
+
+func (r *recordingTracer) StartWrite(ctx context.Context, address string, size int) (context.Context, func(error)) {
+	tc, _ := TraceFromContext(ctx)
+	tc.SpanID[7]++
+	r.Lock()
+	r.writes = append(r.writes, tc)
+	r.Unlock()
+	return ContextWithTrace(ctx, tc), func(error) {}
+}
+
+func (r *recordingTracer) StartCallback(ctx context.Context, conn ConnectionInfo, size int) (context.Context, func(error)) {
+	tc, _ := TraceFromContext(ctx)
+	r.Lock()
+	r.callbacks = append(r.callbacks, tc)
+	r.Unlock()
+	tc.SpanID[7]++
+	return ContextWithTrace(ctx, tc), func(error) {}
+}
+
+func TestTraceContextPropagatesAcrossHop(t *testing.T) {
+	received := make(chan TraceContext, 1)
+	listenerTracer := &recordingTracer{}
+	cfg := TCPListenerConfig{
+		Address:        FormatAddress("", strconv.Itoa(5043)),
+		EnableMetadata: true,
+		Tracer:         listenerTracer,
+		ContextCallback: func(ctx context.Context, data []byte) error {
+			tc, _ := TraceFromContext(ctx)
+			if string(data) == "hello" {
+				received <- tc
+			}
+			return nil
+		},
+	}
+	l, err := ListenTCP(cfg)
+	if err != nil {
+		t.Fatalf("Could not Listen on %s: %s", cfg.Address, err)
+	}
+	l.StartListeningAsync()
+	defer l.Close()
+
+	connTracer := &recordingTracer{}
+	connCfg := TCPConnConfig{
+		Address:        FormatAddress("127.0.0.1", strconv.Itoa(5043)),
+		EnableMetadata: true,
+		Tracer:         connTracer,
+	}
+	c, err := DialTCP(&connCfg)
+	if err != nil {
+		t.Fatalf("Failed to open connection to %s: %s", connCfg.Address, err)
+	}
+	defer c.Close()
+
+	// A plain Write is traced too, with no parent span to propagate
+	if _, err := c.Write([]byte("untraced")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+	root, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, err := c.WriteContext(ContextWithTrace(context.Background(), root), []byte("hello")); err != nil {
+		t.Fatalf("Failed to write to %s: %s", connCfg.Address, err)
+	}
+
+	select {
+	case tc := <-received:
+		connTracer.Lock()
+		writes := append([]TraceContext(nil), connTracer.writes...)
+		connTracer.Unlock()
+		if len(writes) != 2 || writes[0].TraceID != ([16]byte{}) {
+			t.Fatalf("Expected both writes to be traced, the first without a parent, actually got %v", writes)
+		}
+		writeSpan := writes[1]
+		listenerTracer.Lock()
+		propagated := listenerTracer.callbacks[len(listenerTracer.callbacks)-1]
+		listenerTracer.Unlock()
+		if propagated != writeSpan {
+			t.Errorf("Expected the write span %s to be propagated, actually got %s", writeSpan, propagated)
+		}
+		if tc.TraceID != root.TraceID || tc.SpanID == writeSpan.SpanID {
+			t.Errorf("Expected the callback to receive the tracer's child span, actually got %s", tc)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the traced message to be received")
+	}
+}
@@ -11,10 +11,19 @@ func byteArrayToUInt32(bytes []byte) (result int64, bytesRead int) {
 
 func intToByteArray(value int64, bufferSize int) []byte {
 	toWriteLen := make([]byte, bufferSize)
-	binary.PutVarint(toWriteLen, value)
+	putHeader(toWriteLen, value)
 	return toWriteLen
 }
 
+// putHeader encodes value into an existing header buffer, clearing any bytes
+// left over from a previous, longer encoding
+func putHeader(header []byte, value int64) {
+	n := binary.PutVarint(header, value)
+	for i := n; i < len(header); i++ {
+		header[i] = 0
+	}
+}
+
 // Formula for taking size in bytes and calculating # of bits to express that size
 // http://www.exploringbinary.com/number-of-bits-in-a-decimal-integer/
 func messageSizeToBitLength(messageSize int) int {